@@ -1,20 +1,36 @@
 package main
 
 import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
 	"context"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
 	"fmt"
 	"io/fs"
+	"net"
 	"net/http"
 	"os"
 	"path/filepath"
 	"slices"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/cucumber/godog"
 	messages "github.com/cucumber/messages/go/v21"
 	"github.com/google/go-cmp/cmp"
 	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/layout"
 	"github.com/google/go-containerregistry/pkg/v1/remote"
 )
 
@@ -39,6 +55,10 @@ const (
 	testRegistryKey = contextKey("test-registry")
 	caOverrideKey   = contextKey("ca-override")
 	extraBindsKey   = contextKey("extra-binds")
+	createOptsKey   = contextKey("create-opts")
+	useOptsKey      = contextKey("use-opts")
+	clientCertKey   = contextKey("client-cert")
+	tokenServiceKey = contextKey("token-service")
 )
 
 func TestFeatures(t *testing.T) {
@@ -72,11 +92,54 @@ func initializeScenario(sc *godog.ScenarioContext) {
 	sc.Step(`^running in debug mode$`, runningInDebugMode)
 	sc.Step(`^the logs contain words: "([^"]*)"$`, theLogsContainWords)
 	sc.Step(`^the logs contain line: "([^"]*)"$`, theLogsContainLine)
+	sc.Step(`^the logs contain lines:$`, theLogsContainLines)
 	sc.Step(`^the artifact creation for path "([^"]*)" is skipped$`, artifactCreationForPathIsSkipped)
 	sc.Step(`^an dummy artifact "([^"]*)"$`, createDummyArtifact)
 	sc.Step(`^the CA_FILE is set to the registry certificate$`, caFileSetToRegistryCert)
 	sc.Step(`^the CA_FILE is set to a decoy certificate$`, caFileSetToDecoyCert)
 	sc.Step(`^the registry CA is in the system trust store$`, registryCAInSystemTrustStore)
+	sc.Step(`^artifacts are created with options: "([^"]*)"$`, artifactsCreatedWithOptions)
+	sc.Step(`^the environment variable "([^"]*)" is set to "([^"]*)"$`, environmentVariableIsSet)
+	sc.Step(`^the modification time of the source files is changed$`, sourceFilesModificationTimeChanged)
+	sc.Step(`^artifacts "([^"]*)" and "([^"]*)" have the same digest$`, artifactsHaveSameDigest)
+	sc.Step(`^the restored file "([^"]*)" has modification time (\d+)$`, restoredFileHasModificationTime)
+	sc.Step(`^the layer of artifact "([^"]*)" has media type "([^"]*)"$`, artifactLayerHasMediaType)
+	sc.Step(`^the registry is stopped$`, registryIsStopped)
+	sc.Step(`^creating artifact "([^"]*)" for (?:file|path) "([^"]*)" fails$`, createArtifactFails)
+	sc.Step(`^no result is written for artifact "([^"]*)"$`, noResultWritten)
+	sc.Step(`^the restored file "([^"]*)" does not exist$`, restoredFileDoesNotExist)
+	sc.Step(`^the layer of artifact "([^"]*)" has annotation "([^"]*)" with value:$`, artifactLayerHasAnnotation)
+	sc.Step(`^the manifest of artifact "([^"]*)" has annotation "([^"]*)" with value:$`, artifactManifestHasAnnotation)
+	sc.Step(`^artifact "([^"]*)" is tagged with a tag starting with "([^"]*)"$`, artifactTaggedWithPrefix)
+	sc.Step(`^the registry has no tags$`, registryHasNoTags)
+	sc.Step(`^using artifact "([^"]*)" fails$`, useArtifactFails)
+	sc.Step(`^the archive of artifact "([^"]*)" in the (store directory|cache) is tampered with$`, tamperWithStoredArchive)
+	sc.Step(`^the cache (does not contain|contains) artifact "([^"]*)"$`, cacheContainsArtifact)
+	sc.Step(`^the OCI layout contains artifact "([^"]*)"$`, layoutContainsArtifact)
+	sc.Step(`^the restored file "([^"]*)" contains "([^"]*)"$`, restoredFileContains)
+	sc.Step(`^artifacts are used with options: "([^"]*)"$`, artifactsUsedWithOptions)
+	sc.Step(`^the destination already contains:$`, destinationContains)
+	sc.Step(`^artifacts are created for paths:$`, createArtifactsForPaths)
+	sc.Step(`^artifacts are used:$`, useArtifactsToDestinations)
+	sc.Step(`^using artifacts fails:$`, useArtifactsToDestinationsFails)
+	sc.Step(`^a signing key pair "([^"]*)"$`, signingKeyPair)
+	sc.Step(`^artifact "([^"]*)" is signed with key "([^"]*)"$`, artifactSignedWithKey)
+	sc.Step(`^the provenance of artifact "([^"]*)" lists artifact "([^"]*)" as input$`, provenanceListsInput)
+	sc.Step(`^the provenance of artifact "([^"]*)" records the TaskRun "([^"]*)"$`, provenanceRecordsTaskRun)
+	sc.Step(`^the provenance of artifact "([^"]*)" expires after "([^"]*)"$`, provenanceExpiresAfter)
+	sc.Step(`^a malicious artifact "([^"]*)" with members:$`, createMaliciousArtifact)
+	sc.Step(`^the index of artifact "([^"]*)" lists:$`, artifactIndexLists)
+	sc.Step(`^artifact "([^"]*)" is inspected(?: with options: "([^"]*)")?$`, inspectArtifact)
+	sc.Step(`^the restored files are modified:$`, modifyRestoredFiles)
+	sc.Step(`^the restored files are verified against artifact "([^"]*)"(?: with options: "([^"]*)")?$`, verifyRestoredFiles)
+	sc.Step(`^verifying the restored files against artifact "([^"]*)" fails$`, verifyRestoredFilesFails)
+	sc.Step(`^artifacts "([^"]*)" and "([^"]*)" are compared(?: with options: "([^"]*)")?$`, compareArtifacts)
+	sc.Step(`^the registry requires token authentication$`, registryRequiresTokenAuthentication)
+	sc.Step(`^a registry token is written to "([^"]*)"$`, registryTokenWritten)
+	sc.Step(`^an identity token for the registry is written to the auth file "([^"]*)"$`, identityTokenWritten)
+	sc.Step(`^the logs do not contain the identity token$`, theLogsDoNotContainIdentityToken)
+	sc.Step(`^the registry requires client certificates$`, registryRequiresClientCertificates)
+	sc.Step(`^the certs.d directory of the registry contains:$`, certsDContains)
 }
 
 func initializeTestSuite(suite *godog.TestSuiteContext) {
@@ -127,6 +190,9 @@ func teardownScenario(ctx context.Context, sc *godog.Scenario, _ error) (context
 	if registryID, ok := ctx.Value(testRegistryKey).(string); ok {
 		_ = cleanupContainer(ctx, registryID)
 	}
+	if service, ok := ctx.Value(tokenServiceKey).(*tokenService); ok {
+		_ = service.server.Close()
+	}
 
 	ts, _ := getTestState(ctx)
 	_ = ts.teardown()
@@ -145,6 +211,21 @@ func createSourceFile(ctx context.Context, fname string, content *godog.DocStrin
 }
 
 func createArtifact(ctx context.Context, result string, path string) (context.Context, error) {
+	return createArtifacts(ctx, [][2]string{{result, path}})
+}
+
+func createArtifactsForPaths(ctx context.Context, artifacts *godog.Table) (context.Context, error) {
+	pairs := make([][2]string, 0, len(artifacts.Rows)-1)
+	for _, row := range artifacts.Rows[1:] {
+		pairs = append(pairs, [2]string{row.Cells[0].Value, row.Cells[1].Value})
+	}
+
+	return createArtifacts(ctx, pairs)
+}
+
+// createArtifacts creates the artifacts with the given result names from the given paths in a
+// single invocation.
+func createArtifacts(ctx context.Context, artifacts [][2]string) (context.Context, error) {
 	// resultFile = where the image:sha is stored
 	// sourceFile = the files that are tarred and zipped
 	ts, err := getTestState(ctx)
@@ -155,8 +236,6 @@ func createArtifact(ctx context.Context, result string, path string) (context.Co
 	// Set up the file paths as they will be seen within the container.
 	storePath := fmt.Sprintf("%s:%s/%s", registryHost, registryPort, artifactContainer)
 	mountedTS := ts.forMount(mountedPath)
-	sourceFile := filepath.Join(mountedTS.sourceDir(), path)
-	resultFile := filepath.Join(mountedTS.resultsDir(), result)
 
 	binds, err := containerBinds(ctx, ts)
 	if err != nil {
@@ -167,7 +246,14 @@ func createArtifact(ctx context.Context, result string, path string) (context.Co
 		"create",
 		"--store",
 		storePath,
-		fmt.Sprintf("%s=%s", resultFile, sourceFile),
+	}
+	if opts, ok := ctx.Value(createOptsKey).([]string); ok {
+		cmd = append(cmd, opts...)
+	}
+	for _, artifact := range artifacts {
+		resultFile := filepath.Join(mountedTS.resultsDir(), artifact[0])
+		sourceFile := filepath.Join(mountedTS.sourceDir(), artifact[1])
+		cmd = append(cmd, fmt.Sprintf("%s=%s", resultFile, sourceFile))
 	}
 
 	if ctx, err = runContainer(ctx, cmd, binds, caCert(ctx, mountedTS)); err != nil {
@@ -178,6 +264,30 @@ func createArtifact(ctx context.Context, result string, path string) (context.Co
 }
 
 func useArtifact(ctx context.Context, result string) (context.Context, error) {
+	return useArtifacts(ctx, [][2]string{{result, ""}})
+}
+
+func useArtifactsToDestinations(ctx context.Context, artifacts *godog.Table) (context.Context, error) {
+	pairs := make([][2]string, 0, len(artifacts.Rows)-1)
+	for _, row := range artifacts.Rows[1:] {
+		pairs = append(pairs, [2]string{row.Cells[0].Value, row.Cells[1].Value})
+	}
+
+	return useArtifacts(ctx, pairs)
+}
+
+func useArtifactsToDestinationsFails(ctx context.Context, artifacts *godog.Table) (context.Context, error) {
+	ctx, err := useArtifactsToDestinations(ctx, artifacts)
+	if err == nil {
+		return ctx, errors.New("expected using the artifacts to fail")
+	}
+
+	return ctx, nil
+}
+
+// useArtifacts restores the artifacts with the given result names to the given destinations,
+// relative to the restored directory, in a single invocation.
+func useArtifacts(ctx context.Context, artifacts [][2]string) (context.Context, error) {
 	ts, err := getTestState(ctx)
 	if err != nil {
 		return nil, fmt.Errorf("useArtifact get test state: %w", err)
@@ -188,7 +298,7 @@ func useArtifact(ctx context.Context, result string) (context.Context, error) {
 		return ctx, err
 	}
 
-	cmd, err := useCmd(ts, result)
+	cmd, err := useCmd(ctx, ts, artifacts)
 	if err != nil {
 		return ctx, err
 	}
@@ -222,21 +332,27 @@ func caCert(ctx context.Context, mountedTS testState) string {
 }
 
 // return command and binds
-func useCmd(ts testState, result string) ([]string, error) {
-	// read the result file for the oci location and artifact sha
-	resultInfo, err := os.ReadFile(filepath.Join(ts.resultsDir(), result))
-	if err != nil {
-		return nil, fmt.Errorf("reading result file: %w", err)
+func useCmd(ctx context.Context, ts testState, artifacts [][2]string) ([]string, error) {
+	cmd := []string{"use"}
+	if opts, ok := ctx.Value(useOptsKey).([]string); ok {
+		cmd = append(cmd, opts...)
 	}
 
 	// Set up the file paths as they will be seen within the container.
 	mountedTS := ts.forMount(mountedPath)
-	restoredPath := mountedTS.restoredDir()
 
-	return []string{
-		"use",
-		fmt.Sprintf("%s=%s", resultInfo, restoredPath),
-	}, nil
+	for _, artifact := range artifacts {
+		// read the result file for the oci location and artifact sha
+		resultInfo, err := os.ReadFile(filepath.Join(ts.resultsDir(), artifact[0]))
+		if err != nil {
+			return nil, fmt.Errorf("reading result file: %w", err)
+		}
+
+		restoredPath := filepath.Join(mountedTS.restoredDir(), artifact[1])
+		cmd = append(cmd, fmt.Sprintf("%s=%s", resultInfo, restoredPath))
+	}
+
+	return cmd, nil
 }
 
 func restoredFileShouldMatchSource(ctx context.Context, fname string) (context.Context, error) {
@@ -326,6 +442,27 @@ func createFiles(ctx context.Context, files *godog.Table) (context.Context, erro
 	return ctx, nil
 }
 
+func destinationContains(ctx context.Context, files *godog.Table) (context.Context, error) {
+	ts, err := getTestState(ctx)
+	if err != nil {
+		return ctx, err
+	}
+
+	for _, row := range files.Rows[1:] {
+		fpath := filepath.Join(ts.restoredDir(), row.Cells[0].Value)
+
+		if err := os.MkdirAll(filepath.Dir(fpath), 0755); err != nil {
+			return ctx, err
+		}
+
+		if err := os.WriteFile(fpath, []byte(row.Cells[1].Value), 0644); err != nil {
+			return ctx, err
+		}
+	}
+
+	return ctx, nil
+}
+
 func artifactContains(ctx context.Context, result string, files *godog.Table) (context.Context, error) {
 	ts, err := getTestState(ctx)
 	if err != nil {
@@ -378,7 +515,38 @@ func artifactContains(ctx context.Context, result string, files *godog.Table) (c
 }
 
 func runningInDebugMode(ctx context.Context) (context.Context, error) {
-	return context.WithValue(ctx, environmentKey, []string{"DEBUG=1"}), nil
+	return withEnvironment(ctx, "DEBUG=1"), nil
+}
+
+func environmentVariableIsSet(ctx context.Context, name, value string) (context.Context, error) {
+	return withEnvironment(ctx, fmt.Sprintf("%s=%s", name, value)), nil
+}
+
+// withEnvironment adds the given NAME=value pairs to the environment of the containers run in the
+// scenario, replacing any previously set values of the same variables.
+func withEnvironment(ctx context.Context, vars ...string) context.Context {
+	var env []string
+	if e, ok := ctx.Value(environmentKey).([]string); ok {
+		env = append(env, e...)
+	}
+
+	for _, v := range vars {
+		name, _, _ := strings.Cut(v, "=")
+		env = slices.DeleteFunc(env, func(e string) bool {
+			return strings.HasPrefix(e, name+"=")
+		})
+		env = append(env, v)
+	}
+
+	return context.WithValue(ctx, environmentKey, env)
+}
+
+func artifactsCreatedWithOptions(ctx context.Context, options string) (context.Context, error) {
+	return context.WithValue(ctx, createOptsKey, strings.Fields(options)), nil
+}
+
+func artifactsUsedWithOptions(ctx context.Context, options string) (context.Context, error) {
+	return context.WithValue(ctx, useOptsKey, strings.Fields(options)), nil
 }
 
 func theLogsContainWords(ctx context.Context, expected string) (context.Context, error) {
@@ -403,6 +571,18 @@ func theLogsContainLine(ctx context.Context, line string) (context.Context, erro
 	return ctx, nil
 }
 
+// theLogsContainLines checks that the logs contain each of the lines, leading and trailing spaces
+// are ignored.
+func theLogsContainLines(ctx context.Context, lines *godog.DocString) (context.Context, error) {
+	for _, line := range strings.Split(lines.Content, "\n") {
+		if ctx, err := theLogsContainLine(ctx, strings.TrimSpace(line)); err != nil {
+			return ctx, err
+		}
+	}
+
+	return ctx, nil
+}
+
 func artifactCreationForPathIsSkipped(ctx context.Context, path string) (context.Context, error) {
 	registry, err := name.NewRegistry(fmt.Sprintf("0.0.0.0:%s", registryPort))
 	if err != nil {
@@ -496,3 +676,1139 @@ func registryCAInSystemTrustStore(ctx context.Context) (context.Context, error)
 
 	return ctx, nil
 }
+
+func sourceFilesModificationTimeChanged(ctx context.Context) (context.Context, error) {
+	ts, err := getTestState(ctx)
+	if err != nil {
+		return ctx, err
+	}
+
+	// Move the timestamps far enough from the time the files were created so that a difference is
+	// recorded in the archive unless timestamps are normalized.
+	mtime := time.Now().Add(-24 * time.Hour)
+
+	return ctx, filepath.WalkDir(ts.sourceDir(), func(path string, _ fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		return os.Chtimes(path, mtime, mtime)
+	})
+}
+
+func artifactURI(ts testState, result string) (string, error) {
+	uri, err := os.ReadFile(filepath.Join(ts.resultsDir(), result))
+	if err != nil {
+		return "", fmt.Errorf("reading result file: %w", err)
+	}
+
+	return string(uri), nil
+}
+
+func artifactDigest(ts testState, result string) (string, error) {
+	uri, err := artifactURI(ts, result)
+	if err != nil {
+		return "", err
+	}
+
+	_, digest, found := strings.Cut(uri, "@")
+	if !found {
+		return "", fmt.Errorf("no digest in the artifact uri: %q", uri)
+	}
+
+	return digest, nil
+}
+
+func artifactsHaveSameDigest(ctx context.Context, first, second string) (context.Context, error) {
+	ts, err := getTestState(ctx)
+	if err != nil {
+		return ctx, err
+	}
+
+	firstDigest, err := artifactDigest(ts, first)
+	if err != nil {
+		return ctx, err
+	}
+
+	secondDigest, err := artifactDigest(ts, second)
+	if err != nil {
+		return ctx, err
+	}
+
+	if firstDigest != secondDigest {
+		return ctx, fmt.Errorf("artifact %q has digest %s, but artifact %q has digest %s", first, firstDigest, second, secondDigest)
+	}
+
+	return ctx, nil
+}
+
+func restoredFileHasModificationTime(ctx context.Context, fname string, epoch int64) (context.Context, error) {
+	ts, err := getTestState(ctx)
+	if err != nil {
+		return ctx, err
+	}
+
+	info, err := os.Stat(filepath.Join(ts.restoredDir(), fname))
+	if err != nil {
+		return ctx, fmt.Errorf("stat restored file: %w", err)
+	}
+
+	if got := info.ModTime().Unix(); got != epoch {
+		return ctx, fmt.Errorf("restored file %q has modification time %d, expected %d", fname, got, epoch)
+	}
+
+	return ctx, nil
+}
+
+func artifactLayerHasMediaType(ctx context.Context, result, mediaType string) (context.Context, error) {
+	ts, err := getTestState(ctx)
+	if err != nil {
+		return ctx, err
+	}
+
+	uri, err := artifactURI(ts, result)
+	if err != nil {
+		return ctx, err
+	}
+
+	layer, err := artifactLayer(ctx, uri)
+	if err != nil {
+		return ctx, err
+	}
+
+	if got := string(layer.MediaType); got != mediaType {
+		return ctx, fmt.Errorf("artifact %q has media type %q, expected %q", result, got, mediaType)
+	}
+
+	return ctx, nil
+}
+
+func registryIsStopped(ctx context.Context) (context.Context, error) {
+	registryID, ok := ctx.Value(testRegistryKey).(string)
+	if !ok {
+		return ctx, errors.New("registry is not running")
+	}
+
+	return ctx, stopRegistry(ctx, registryID)
+}
+
+func createArtifactFails(ctx context.Context, result string, path string) (context.Context, error) {
+	ctx, err := createArtifact(ctx, result, path)
+	if err == nil {
+		return ctx, fmt.Errorf("expected creating artifact %q to fail", result)
+	}
+
+	return ctx, nil
+}
+
+func noResultWritten(ctx context.Context, result string) (context.Context, error) {
+	ts, err := getTestState(ctx)
+	if err != nil {
+		return ctx, err
+	}
+
+	resultFile := filepath.Join(ts.resultsDir(), result)
+	if _, err := os.Stat(resultFile); !errors.Is(err, fs.ErrNotExist) {
+		return ctx, fmt.Errorf("expected no result file at %q, got: %v", resultFile, err)
+	}
+
+	return ctx, nil
+}
+
+func restoredFileDoesNotExist(ctx context.Context, fname string) (context.Context, error) {
+	ts, err := getTestState(ctx)
+	if err != nil {
+		return ctx, err
+	}
+
+	fpath := filepath.Join(ts.restoredDir(), fname)
+	if _, err := os.Lstat(fpath); !errors.Is(err, fs.ErrNotExist) {
+		return ctx, fmt.Errorf("expected restored file %q not to exist, got: %v", fpath, err)
+	}
+
+	return ctx, nil
+}
+
+func restoredFileContains(ctx context.Context, fname, expected string) (context.Context, error) {
+	ts, err := getTestState(ctx)
+	if err != nil {
+		return ctx, err
+	}
+
+	got, err := os.ReadFile(filepath.Join(ts.restoredDir(), fname))
+	if err != nil {
+		return ctx, fmt.Errorf("reading restored file: %w", err)
+	}
+
+	if string(got) != expected {
+		return ctx, fmt.Errorf("restored file %q does not match: \n%s", fname, cmp.Diff(expected, string(got)))
+	}
+
+	return ctx, nil
+}
+
+func artifactLayerHasAnnotation(ctx context.Context, result, key string, value *godog.DocString) (context.Context, error) {
+	ts, err := getTestState(ctx)
+	if err != nil {
+		return ctx, err
+	}
+
+	uri, err := artifactURI(ts, result)
+	if err != nil {
+		return ctx, err
+	}
+
+	layer, err := artifactLayer(ctx, uri)
+	if err != nil {
+		return ctx, err
+	}
+
+	got, ok := layer.Annotations[key]
+	if !ok {
+		return ctx, fmt.Errorf("artifact %q has no annotation %q, annotations: %v", result, key, layer.Annotations)
+	}
+
+	if expected := strings.TrimSpace(value.Content); got != expected {
+		return ctx, fmt.Errorf("annotation %q of artifact %q does not match: \n%s", key, result, cmp.Diff(expected, got))
+	}
+
+	return ctx, nil
+}
+
+func artifactManifestHasAnnotation(ctx context.Context, result, key string, value *godog.DocString) (context.Context, error) {
+	ts, err := getTestState(ctx)
+	if err != nil {
+		return ctx, err
+	}
+
+	uri, err := artifactURI(ts, result)
+	if err != nil {
+		return ctx, err
+	}
+
+	manifest, err := artifactManifest(ctx, uri)
+	if err != nil {
+		return ctx, err
+	}
+
+	got, ok := manifest.Annotations[key]
+	if !ok {
+		return ctx, fmt.Errorf("the manifest of artifact %q has no annotation %q, annotations: %v", result, key, manifest.Annotations)
+	}
+
+	if expected := strings.TrimSpace(value.Content); got != expected {
+		return ctx, fmt.Errorf("annotation %q of the manifest of artifact %q does not match: \n%s", key, result, cmp.Diff(expected, got))
+	}
+
+	return ctx, nil
+}
+
+func artifactTaggedWithPrefix(ctx context.Context, result, prefix string) (context.Context, error) {
+	ts, err := getTestState(ctx)
+	if err != nil {
+		return ctx, err
+	}
+
+	uri, err := artifactURI(ts, result)
+	if err != nil {
+		return ctx, err
+	}
+
+	tag, err := artifactTag(uri)
+	if err != nil {
+		return ctx, err
+	}
+
+	if !strings.HasPrefix(tag, prefix) {
+		return ctx, fmt.Errorf("artifact %q is tagged with %q, expected a tag starting with %q", result, tag, prefix)
+	}
+
+	// the tag must still reference a manifest containing the artifact
+	if _, err := artifactLayer(ctx, uri); err != nil {
+		return ctx, err
+	}
+
+	return ctx, nil
+}
+
+func registryHasNoTags(ctx context.Context) (context.Context, error) {
+	tags, err := registryTags(ctx)
+	if err != nil {
+		return ctx, fmt.Errorf("listing tags: %w", err)
+	}
+
+	// registries without support for the referrers API list the referrers, e.g. the provenance, in
+	// an index tagged sha256-<digest of the manifest>, those are not tags of the manifest
+	var manifestTags []string
+	for _, tag := range tags {
+		if !referrersTag.MatchString(tag) {
+			manifestTags = append(manifestTags, tag)
+		}
+	}
+
+	if len(manifestTags) != 0 {
+		return ctx, fmt.Errorf("expected no tags in the registry, found: %v", manifestTags)
+	}
+
+	return ctx, nil
+}
+
+func useArtifactFails(ctx context.Context, result string) (context.Context, error) {
+	ctx, err := useArtifact(ctx, result)
+	if err == nil {
+		return ctx, fmt.Errorf("expected using artifact %q to fail", result)
+	}
+
+	return ctx, nil
+}
+
+func tamperWithStoredArchive(ctx context.Context, result, location string) (context.Context, error) {
+	ts, err := getTestState(ctx)
+	if err != nil {
+		return ctx, err
+	}
+
+	digest, err := artifactDigest(ts, result)
+	if err != nil {
+		return ctx, err
+	}
+
+	dir := ts.storeDir()
+	if location == "cache" {
+		dir = ts.cacheDir()
+	}
+
+	archive := filepath.Join(dir, strings.Replace(digest, ":", "/", 1))
+
+	f, err := os.OpenFile(archive, os.O_APPEND|os.O_WRONLY, 0)
+	if err != nil {
+		return ctx, fmt.Errorf("opening stored archive: %w", err)
+	}
+	defer func() { _ = f.Close() }()
+
+	if _, err := f.WriteString("tampered"); err != nil {
+		return ctx, fmt.Errorf("tampering with stored archive: %w", err)
+	}
+
+	return ctx, nil
+}
+
+func cacheContainsArtifact(ctx context.Context, contains, result string) (context.Context, error) {
+	ts, err := getTestState(ctx)
+	if err != nil {
+		return ctx, err
+	}
+
+	digest, err := artifactDigest(ts, result)
+	if err != nil {
+		return ctx, err
+	}
+
+	_, err = os.Stat(filepath.Join(ts.cacheDir(), strings.Replace(digest, ":", "/", 1)))
+	switch {
+	case contains == "contains" && err != nil:
+		return ctx, fmt.Errorf("expected the cache to contain artifact %q: %w", result, err)
+	case contains == "does not contain" && !errors.Is(err, fs.ErrNotExist):
+		return ctx, fmt.Errorf("expected the cache not to contain artifact %q, got: %v", result, err)
+	}
+
+	return ctx, nil
+}
+
+func layoutContainsArtifact(ctx context.Context, result string) (context.Context, error) {
+	ts, err := getTestState(ctx)
+	if err != nil {
+		return ctx, err
+	}
+
+	digest, err := artifactDigest(ts, result)
+	if err != nil {
+		return ctx, err
+	}
+
+	index, err := layout.ImageIndexFromPath(ts.layoutDir())
+	if err != nil {
+		return ctx, fmt.Errorf("reading OCI layout: %w", err)
+	}
+
+	indexManifest, err := index.IndexManifest()
+	if err != nil {
+		return ctx, fmt.Errorf("reading OCI layout index: %w", err)
+	}
+
+	for _, desc := range indexManifest.Manifests {
+		img, err := index.Image(desc.Digest)
+		if err != nil {
+			return ctx, fmt.Errorf("reading image %s from OCI layout: %w", desc.Digest, err)
+		}
+
+		manifest, err := img.Manifest()
+		if err != nil {
+			return ctx, fmt.Errorf("reading manifest %s from OCI layout: %w", desc.Digest, err)
+		}
+
+		for _, layer := range manifest.Layers {
+			if layer.Digest.String() == digest {
+				return ctx, nil
+			}
+		}
+	}
+
+	return ctx, fmt.Errorf("no manifest with the layer %s found in the OCI layout", digest)
+}
+
+// createMaliciousArtifact pushes an archive with the given members directly to the registry, as
+// create-oci.sh would never produce such an archive, and writes its URI to the result file.
+func createMaliciousArtifact(ctx context.Context, result string, members *godog.Table) (context.Context, error) {
+	ts, err := getTestState(ctx)
+	if err != nil {
+		return ctx, err
+	}
+
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+
+	for i, row := range members.Rows {
+		if i == 0 {
+			continue // header row
+		}
+
+		hdr := tar.Header{
+			Name:     row.Cells[1].Value,
+			Linkname: row.Cells[2].Value,
+			Mode:     0644,
+			ModTime:  time.Unix(0, 0),
+		}
+		var content []byte
+		switch typ := row.Cells[0].Value; typ {
+		case "file":
+			hdr.Typeflag = tar.TypeReg
+			content = []byte("malicious")
+			hdr.Size = int64(len(content))
+		case "dir":
+			hdr.Typeflag = tar.TypeDir
+			hdr.Mode = 0755
+		case "symlink":
+			hdr.Typeflag = tar.TypeSymlink
+		case "hardlink":
+			hdr.Typeflag = tar.TypeLink
+		default:
+			return ctx, fmt.Errorf("unsupported archive member type %q", typ)
+		}
+
+		if err := tw.WriteHeader(&hdr); err != nil {
+			return ctx, fmt.Errorf("writing archive member %q: %w", hdr.Name, err)
+		}
+		if _, err := tw.Write(content); err != nil {
+			return ctx, fmt.Errorf("writing archive member %q: %w", hdr.Name, err)
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		return ctx, err
+	}
+	if err := gz.Close(); err != nil {
+		return ctx, err
+	}
+
+	digest, err := pushArchive(ctx, buf.Bytes())
+	if err != nil {
+		return ctx, err
+	}
+
+	uri := fmt.Sprintf("oci:%s:%s/%s@%s", registryHost, registryPort, artifactContainer, digest)
+
+	return ctx, os.WriteFile(filepath.Join(ts.resultsDir(), result), []byte(uri), 0644)
+}
+
+// signingKeyPair generates a key pair, saved as <name>.key and <name>.pub in the certificates
+// directory.
+func signingKeyPair(ctx context.Context, name string) (context.Context, error) {
+	ts, err := getTestState(ctx)
+	if err != nil {
+		return ctx, err
+	}
+
+	key := filepath.Join(ts.certsDir(), name+".key")
+	pub := filepath.Join(ts.certsDir(), name+".pub")
+
+	return ctx, generateSigningKeyPair(key, pub)
+}
+
+// artifactSignedWithKey verifies the signature attached to the manifest of the artifact the same
+// way cosign does, independently of use-oci.sh.
+func artifactSignedWithKey(ctx context.Context, result, name string) (context.Context, error) {
+	ts, err := getTestState(ctx)
+	if err != nil {
+		return ctx, err
+	}
+
+	pubPEM, err := os.ReadFile(filepath.Join(ts.certsDir(), name+".pub"))
+	if err != nil {
+		return ctx, err
+	}
+
+	block, _ := pem.Decode(pubPEM)
+	if block == nil {
+		return ctx, fmt.Errorf("no PEM data found in the public key %q", name)
+	}
+
+	pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return ctx, err
+	}
+
+	ecdsaPub, ok := pub.(*ecdsa.PublicKey)
+	if !ok {
+		return ctx, fmt.Errorf("public key %q is not an ECDSA key", name)
+	}
+
+	uri, err := artifactURI(ts, result)
+	if err != nil {
+		return ctx, err
+	}
+
+	manifestDigest, signatures, err := artifactReferrers(ctx, uri, cosignSignatureType)
+	if err != nil {
+		return ctx, err
+	}
+
+	for _, s := range signatures {
+		var payload struct {
+			Critical struct {
+				Image struct {
+					DockerManifestDigest string `json:"docker-manifest-digest"`
+				} `json:"image"`
+			} `json:"critical"`
+		}
+		if err := json.Unmarshal(s.content, &payload); err != nil {
+			return ctx, fmt.Errorf("parsing signature payload: %w", err)
+		}
+
+		if payload.Critical.Image.DockerManifestDigest != manifestDigest.String() {
+			continue
+		}
+
+		signature, err := base64.StdEncoding.DecodeString(s.annotations["dev.cosignproject.cosign/signature"])
+		if err != nil {
+			return ctx, fmt.Errorf("decoding signature: %w", err)
+		}
+
+		digest := sha256.Sum256(s.content)
+		if ecdsa.VerifyASN1(ecdsaPub, digest[:], signature) {
+			return ctx, nil
+		}
+	}
+
+	return ctx, fmt.Errorf("no valid signature of manifest %s found for artifact %q, found %d signature(s)", manifestDigest, result, len(signatures))
+}
+
+// provenanceStatement is the part of the in-toto statement attached by create-oci.sh that is
+// checked by the tests.
+type provenanceStatement struct {
+	Subject []struct {
+		Digest map[string]string `json:"digest"`
+	} `json:"subject"`
+	Predicate struct {
+		BuildDefinition struct {
+			InternalParameters struct {
+				Tekton struct {
+					TaskRun string `json:"taskRun"`
+				} `json:"tekton"`
+			} `json:"internalParameters"`
+			ResolvedDependencies []struct {
+				URI string `json:"uri"`
+			} `json:"resolvedDependencies"`
+		} `json:"buildDefinition"`
+	} `json:"predicate"`
+}
+
+// artifactProvenance finds the provenance statement with the artifact as its subject among the
+// referrers of the artifact's manifest.
+func artifactProvenance(ctx context.Context, result string) (provenanceStatement, error) {
+	ts, err := getTestState(ctx)
+	if err != nil {
+		return provenanceStatement{}, err
+	}
+
+	uri, err := artifactURI(ts, result)
+	if err != nil {
+		return provenanceStatement{}, err
+	}
+
+	digest, err := artifactDigest(ts, result)
+	if err != nil {
+		return provenanceStatement{}, err
+	}
+
+	_, layers, err := artifactReferrers(ctx, uri, provenanceType)
+	if err != nil {
+		return provenanceStatement{}, err
+	}
+
+	for _, l := range layers {
+		var statement provenanceStatement
+		if err := json.Unmarshal(l.content, &statement); err != nil {
+			return provenanceStatement{}, fmt.Errorf("parsing provenance: %w", err)
+		}
+
+		for _, subject := range statement.Subject {
+			if "sha256:"+subject.Digest["sha256"] == digest {
+				return statement, nil
+			}
+		}
+	}
+
+	return provenanceStatement{}, fmt.Errorf("no provenance found for artifact %q among %d statement(s)", result, len(layers))
+}
+
+func provenanceListsInput(ctx context.Context, result, input string) (context.Context, error) {
+	ts, err := getTestState(ctx)
+	if err != nil {
+		return ctx, err
+	}
+
+	inputURI, err := artifactURI(ts, input)
+	if err != nil {
+		return ctx, err
+	}
+
+	statement, err := artifactProvenance(ctx, result)
+	if err != nil {
+		return ctx, err
+	}
+
+	var uris []string
+	for _, dependency := range statement.Predicate.BuildDefinition.ResolvedDependencies {
+		uris = append(uris, dependency.URI)
+	}
+
+	if !slices.Contains(uris, inputURI) {
+		return ctx, fmt.Errorf("the provenance of artifact %q does not list %q as input, inputs: %v", result, inputURI, uris)
+	}
+
+	return ctx, nil
+}
+
+func provenanceRecordsTaskRun(ctx context.Context, result, taskRun string) (context.Context, error) {
+	statement, err := artifactProvenance(ctx, result)
+	if err != nil {
+		return ctx, err
+	}
+
+	if got := statement.Predicate.BuildDefinition.InternalParameters.Tekton.TaskRun; got != taskRun {
+		return ctx, fmt.Errorf("the provenance of artifact %q records the TaskRun %q, expected %q", result, got, taskRun)
+	}
+
+	return ctx, nil
+}
+
+func provenanceExpiresAfter(ctx context.Context, result, expiresAfter string) (context.Context, error) {
+	ts, err := getTestState(ctx)
+	if err != nil {
+		return ctx, err
+	}
+
+	uri, err := artifactURI(ts, result)
+	if err != nil {
+		return ctx, err
+	}
+
+	_, layers, err := artifactReferrers(ctx, uri, provenanceType)
+	if err != nil {
+		return ctx, err
+	}
+
+	if len(layers) == 0 {
+		return ctx, fmt.Errorf("no provenance attached to artifact %q", result)
+	}
+
+	for _, l := range layers {
+		if got := l.manifestAnnotations["quay.expires-after"]; got != expiresAfter {
+			return ctx, fmt.Errorf("the provenance of artifact %q expires after %q, expected %q", result, got, expiresAfter)
+		}
+	}
+
+	return ctx, nil
+}
+
+// fileIndex is the index of the files in an artifact, as printed by the index operation.
+type fileIndex struct {
+	Artifact string `json:"artifact"`
+	Files    []struct {
+		Path   string `json:"path"`
+		Type   string `json:"type"`
+		Mode   string `json:"mode"`
+		Size   int64  `json:"size"`
+		SHA256 string `json:"sha256"`
+		Target string `json:"target"`
+	} `json:"files"`
+}
+
+// artifactIndex runs the index operation for the artifact and parses the index it writes.
+func artifactIndex(ctx context.Context, result string) (context.Context, fileIndex, error) {
+	ts, err := getTestState(ctx)
+	if err != nil {
+		return ctx, fileIndex{}, err
+	}
+
+	uri, err := artifactURI(ts, result)
+	if err != nil {
+		return ctx, fileIndex{}, err
+	}
+
+	binds, err := containerBinds(ctx, ts)
+	if err != nil {
+		return ctx, fileIndex{}, err
+	}
+
+	mountedTS := ts.forMount(mountedPath)
+	output := result + ".index.json"
+	cmd := []string{"index", "--output", filepath.Join(mountedTS.resultsDir(), output), uri}
+	if ctx, err = runContainer(ctx, cmd, binds, caCert(ctx, mountedTS)); err != nil {
+		return ctx, fileIndex{}, fmt.Errorf("indexing artifact: %w", err)
+	}
+
+	content, err := os.ReadFile(filepath.Join(ts.resultsDir(), output))
+	if err != nil {
+		return ctx, fileIndex{}, err
+	}
+
+	var index fileIndex
+	if err := json.Unmarshal(content, &index); err != nil {
+		return ctx, fileIndex{}, fmt.Errorf("parsing index: %w", err)
+	}
+
+	return ctx, index, nil
+}
+
+// artifactIndexLists checks that the index of the artifact lists exactly the files in the table,
+// with the given type. The content column holds the content of regular files, checked against
+// their size and digest, or the target of symbolic links.
+func artifactIndexLists(ctx context.Context, result string, files *godog.Table) (context.Context, error) {
+	ts, err := getTestState(ctx)
+	if err != nil {
+		return ctx, err
+	}
+
+	digest, err := artifactDigest(ts, result)
+	if err != nil {
+		return ctx, err
+	}
+
+	ctx, index, err := artifactIndex(ctx, result)
+	if err != nil {
+		return ctx, err
+	}
+
+	if index.Artifact != digest {
+		return ctx, fmt.Errorf("the index is of artifact %q, expected %q", index.Artifact, digest)
+	}
+
+	type entry struct {
+		Type    string
+		Content string
+	}
+
+	expected := map[string]entry{}
+	for _, row := range files.Rows[1:] {
+		expected[row.Cells[0].Value] = entry{Type: row.Cells[1].Value, Content: row.Cells[2].Value}
+	}
+
+	got := map[string]entry{}
+	for _, f := range index.Files {
+		e := entry{Type: f.Type}
+		switch f.Type {
+		case "file":
+			// the content is only known for the expected files, compare the checksums instead
+			if want, ok := expected[f.Path]; ok && want.Type == "file" {
+				checksum := sha256.Sum256([]byte(want.Content))
+				if f.SHA256 == fmt.Sprintf("%x", checksum) && f.Size == int64(len(want.Content)) {
+					e.Content = want.Content
+				} else {
+					e.Content = fmt.Sprintf("(%d bytes, sha256:%s)", f.Size, f.SHA256)
+				}
+			}
+		case "symlink":
+			e.Content = f.Target
+		}
+		got[f.Path] = e
+	}
+
+	if !cmp.Equal(expected, got) {
+		return ctx, fmt.Errorf("the index of artifact %q does not list the expected files:\n%s", result, cmp.Diff(expected, got))
+	}
+
+	return ctx, nil
+}
+
+// inspectArtifact runs the inspect operation for the artifact, the output is checked via the logs.
+func inspectArtifact(ctx context.Context, result, options string) (context.Context, error) {
+	ts, err := getTestState(ctx)
+	if err != nil {
+		return ctx, err
+	}
+
+	uri, err := artifactURI(ts, result)
+	if err != nil {
+		return ctx, err
+	}
+
+	binds, err := containerBinds(ctx, ts)
+	if err != nil {
+		return ctx, err
+	}
+
+	cmd := append([]string{"inspect"}, strings.Fields(options)...)
+	cmd = append(cmd, uri)
+
+	mountedTS := ts.forMount(mountedPath)
+	if ctx, err = runContainer(ctx, cmd, binds, caCert(ctx, mountedTS)); err != nil {
+		return ctx, fmt.Errorf("inspecting artifact: %w", err)
+	}
+
+	return ctx, nil
+}
+
+// modifyRestoredFiles adds, modifies or removes the restored files in the table, based on the value
+// of the change column.
+func modifyRestoredFiles(ctx context.Context, files *godog.Table) (context.Context, error) {
+	ts, err := getTestState(ctx)
+	if err != nil {
+		return ctx, err
+	}
+
+	for _, row := range files.Rows[1:] {
+		change, path, content := row.Cells[0].Value, row.Cells[1].Value, row.Cells[2].Value
+		fpath := filepath.Join(ts.restoredDir(), path)
+
+		switch change {
+		case "add":
+			if err := os.MkdirAll(filepath.Dir(fpath), 0755); err != nil {
+				return ctx, err
+			}
+			if err := os.WriteFile(fpath, []byte(content), 0644); err != nil {
+				return ctx, err
+			}
+		case "modify":
+			// the restored files are read-only
+			if err := os.Chmod(fpath, 0644); err != nil {
+				return ctx, err
+			}
+			if err := os.WriteFile(fpath, []byte(content), 0644); err != nil {
+				return ctx, err
+			}
+		case "remove":
+			if err := os.Remove(fpath); err != nil {
+				return ctx, err
+			}
+		default:
+			return ctx, fmt.Errorf("unsupported change %q, expected one of: add, modify, remove", change)
+		}
+	}
+
+	return ctx, nil
+}
+
+// verifyRestoredFiles runs the verify operation comparing the restored directory with the artifact.
+func verifyRestoredFiles(ctx context.Context, result, options string) (context.Context, error) {
+	ts, err := getTestState(ctx)
+	if err != nil {
+		return ctx, err
+	}
+
+	uri, err := artifactURI(ts, result)
+	if err != nil {
+		return ctx, err
+	}
+
+	binds, err := containerBinds(ctx, ts)
+	if err != nil {
+		return ctx, err
+	}
+
+	mountedTS := ts.forMount(mountedPath)
+	cmd := append([]string{"verify"}, strings.Fields(options)...)
+	cmd = append(cmd, fmt.Sprintf("%s=%s", uri, mountedTS.restoredDir()))
+	if ctx, err = runContainer(ctx, cmd, binds, caCert(ctx, mountedTS)); err != nil {
+		return ctx, fmt.Errorf("verifying artifact: %w", err)
+	}
+
+	return ctx, nil
+}
+
+func verifyRestoredFilesFails(ctx context.Context, result string) (context.Context, error) {
+	ctx, err := verifyRestoredFiles(ctx, result, "")
+	if err == nil {
+		return ctx, errors.New("expected verifying the restored files to fail")
+	}
+
+	return ctx, nil
+}
+
+// compareArtifacts runs the diff operation for the two artifacts, the output is checked via the
+// logs.
+func compareArtifacts(ctx context.Context, first, second, options string) (context.Context, error) {
+	ts, err := getTestState(ctx)
+	if err != nil {
+		return ctx, err
+	}
+
+	cmd := append([]string{"diff"}, strings.Fields(options)...)
+	for _, result := range []string{first, second} {
+		uri, err := artifactURI(ts, result)
+		if err != nil {
+			return ctx, err
+		}
+		cmd = append(cmd, uri)
+	}
+
+	binds, err := containerBinds(ctx, ts)
+	if err != nil {
+		return ctx, err
+	}
+
+	mountedTS := ts.forMount(mountedPath)
+	if ctx, err = runContainer(ctx, cmd, binds, caCert(ctx, mountedTS)); err != nil {
+		return ctx, fmt.Errorf("comparing artifacts: %w", err)
+	}
+
+	return ctx, nil
+}
+
+// tokenIssuer is the issuer of the registry tokens minted by the tests, the registry accepts only
+// tokens from it once token authentication is required.
+const tokenIssuer = "trusted-artifacts-acceptance"
+
+// tokenService is the token endpoint of the registry requiring token authentication, i.e. its
+// realm. It runs on the host, where the containers reach it as tokenServiceHost, and only exchanges
+// the identity token of the scenario for a registry token, as docker and oras request it for
+// identitytoken entries of the auth file: an OAuth2 refresh token grant.
+type tokenService struct {
+	server        *http.Server
+	realm         string
+	identityToken string
+}
+
+func startTokenService(ts testState) (*tokenService, error) {
+	secret := make([]byte, 16)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, err
+	}
+	service := &tokenService{identityToken: hex.EncodeToString(secret)}
+
+	// listening on all interfaces, the containers connect via the gateway of their network
+	listener, err := net.Listen("tcp", ":0")
+	if err != nil {
+		return nil, err
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.PostFormValue("grant_type") != "refresh_token" ||
+			r.PostFormValue("refresh_token") != service.identityToken {
+			http.Error(w, "invalid identity token", http.StatusUnauthorized)
+			return
+		}
+
+		token, err := registryToken(ts.tokenCert(), ts.tokenKey(), tokenIssuer, registryHost, artifactContainer)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]any{"access_token": token, "expires_in": 300})
+	})
+
+	service.server = &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	service.realm = fmt.Sprintf("http://%s:%d/token", tokenServiceHost, listener.Addr().(*net.TCPAddr).Port)
+	go func() { _ = service.server.Serve(listener) }()
+
+	return service, nil
+}
+
+// registryRequiresTokenAuthentication replaces the registry of the scenario with one that accepts
+// only bearer tokens signed with the token key of the scenario, issued by the token service of the
+// scenario or given to the clients directly.
+func registryRequiresTokenAuthentication(ctx context.Context) (context.Context, error) {
+	ts, err := getTestState(ctx)
+	if err != nil {
+		return ctx, err
+	}
+
+	if err := generateSelfSignedCert(ts.tokenCert(), ts.tokenKey()); err != nil {
+		return ctx, fmt.Errorf("generating token signing certificate: %w", err)
+	}
+
+	service, err := startTokenService(ts)
+	if err != nil {
+		return ctx, fmt.Errorf("starting token service: %w", err)
+	}
+	ctx = context.WithValue(ctx, tokenServiceKey, service)
+
+	if registryID, ok := ctx.Value(testRegistryKey).(string); ok {
+		if err := removeRegistry(ctx, registryID); err != nil {
+			return ctx, err
+		}
+	}
+
+	binds, err := containerBinds(ctx, ts)
+	if err != nil {
+		return ctx, err
+	}
+
+	mountedTS := ts.forMount(mountedPath)
+	registryID, err := runRegistry(ctx, binds, mountedTS.domainCert(), mountedTS.domainKey(),
+		"REGISTRY_AUTH=token",
+		fmt.Sprintf("REGISTRY_AUTH_TOKEN_REALM=%s", service.realm),
+		fmt.Sprintf("REGISTRY_AUTH_TOKEN_SERVICE=%s", registryHost),
+		fmt.Sprintf("REGISTRY_AUTH_TOKEN_ISSUER=%s", tokenIssuer),
+		fmt.Sprintf("REGISTRY_AUTH_TOKEN_ROOTCERTBUNDLE=%s", mountedTS.tokenCert()),
+	)
+	if err != nil {
+		return ctx, fmt.Errorf("running registry with token authentication: %w", err)
+	}
+
+	return context.WithValue(ctx, testRegistryKey, registryID), nil
+}
+
+// registryTokenWritten writes a token granting access to the repository of the artifacts to the
+// given path, relative to the directory mounted in the containers.
+func registryTokenWritten(ctx context.Context, path string) (context.Context, error) {
+	ts, err := getTestState(ctx)
+	if err != nil {
+		return ctx, err
+	}
+
+	token, err := registryToken(ts.tokenCert(), ts.tokenKey(), tokenIssuer, registryHost, artifactContainer)
+	if err != nil {
+		return ctx, fmt.Errorf("minting registry token: %w", err)
+	}
+
+	return ctx, os.WriteFile(filepath.Join(ts.contextDir, path), []byte(token), 0400)
+}
+
+// identityTokenWritten writes an auth file with an identitytoken entry for the registry to the given
+// path, relative to the directory mounted in the containers. The identity token is the one the
+// token service of the scenario exchanges for registry tokens.
+func identityTokenWritten(ctx context.Context, path string) (context.Context, error) {
+	ts, err := getTestState(ctx)
+	if err != nil {
+		return ctx, err
+	}
+
+	service, ok := ctx.Value(tokenServiceKey).(*tokenService)
+	if !ok {
+		return ctx, errors.New("the registry does not require token authentication")
+	}
+
+	auth, err := json.Marshal(map[string]any{
+		"auths": map[string]any{
+			fmt.Sprintf("%s:%s", registryHost, registryPort): map[string]string{
+				"identitytoken": service.identityToken,
+			},
+		},
+	})
+	if err != nil {
+		return ctx, err
+	}
+
+	return ctx, os.WriteFile(filepath.Join(ts.contextDir, path), auth, 0400)
+}
+
+// theLogsDoNotContainIdentityToken checks that the identity token of the scenario, an opaque
+// secret unlike the registry tokens, does not appear in the logs.
+func theLogsDoNotContainIdentityToken(ctx context.Context) (context.Context, error) {
+	service, ok := ctx.Value(tokenServiceKey).(*tokenService)
+	if !ok {
+		return ctx, errors.New("the registry does not require token authentication")
+	}
+
+	logs, _ := ctx.Value(logsKey).(string)
+	if strings.Contains(logs, service.identityToken) {
+		return ctx, fmt.Errorf("logs contain the identity token:\n%s", logs)
+	}
+
+	return ctx, nil
+}
+
+// registryRequiresClientCertificates replaces the registry of the scenario with one that accepts
+// only connections presenting the client certificate of the scenario, i.e. requiring mutual TLS.
+func registryRequiresClientCertificates(ctx context.Context) (context.Context, error) {
+	ts, err := getTestState(ctx)
+	if err != nil {
+		return ctx, err
+	}
+
+	if err := generateSelfSignedCert(ts.clientCert(), ts.clientKey(), x509.ExtKeyUsageClientAuth); err != nil {
+		return ctx, fmt.Errorf("generating client certificate: %w", err)
+	}
+
+	cert, err := tls.LoadX509KeyPair(ts.clientCert(), ts.clientKey())
+	if err != nil {
+		return ctx, fmt.Errorf("loading client certificate: %w", err)
+	}
+	ctx = context.WithValue(ctx, clientCertKey, cert)
+
+	if registryID, ok := ctx.Value(testRegistryKey).(string); ok {
+		if err := removeRegistry(ctx, registryID); err != nil {
+			return ctx, err
+		}
+	}
+
+	binds, err := containerBinds(ctx, ts)
+	if err != nil {
+		return ctx, err
+	}
+
+	// the self-signed client certificate is its own CA
+	mountedTS := ts.forMount(mountedPath)
+	registryID, err := runRegistry(ctx, binds, mountedTS.domainCert(), mountedTS.domainKey(),
+		fmt.Sprintf("REGISTRY_HTTP_TLS_CLIENTCAS_0=%s", mountedTS.clientCert()))
+	if err != nil {
+		return ctx, fmt.Errorf("running registry requiring client certificates: %w", err)
+	}
+
+	return context.WithValue(ctx, testRegistryKey, registryID), nil
+}
+
+// certsDContains copies the given certificates and keys of the scenario to the certs.d directory
+// of the registry, e.g. | ca.crt | registry certificate |. CERT_DIR is set to the certs.d directory.
+func certsDContains(ctx context.Context, files *godog.Table) (context.Context, error) {
+	ts, err := getTestState(ctx)
+	if err != nil {
+		return ctx, err
+	}
+
+	sources := map[string]string{
+		"registry certificate": ts.domainCert(),
+		"decoy certificate":    ts.decoyCert(),
+		"client certificate":   ts.clientCert(),
+		"client key":           ts.clientKey(),
+	}
+
+	dir := filepath.Join(ts.certsD(), fmt.Sprintf("%s:%s", registryHost, registryPort))
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return ctx, err
+	}
+
+	for _, row := range files.Rows[1:] {
+		name, source := row.Cells[0].Value, row.Cells[1].Value
+		path, ok := sources[source]
+		if !ok {
+			return ctx, fmt.Errorf("unknown certs.d content: %q", source)
+		}
+
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return ctx, fmt.Errorf("reading %s: %w", source, err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, name), content, 0400); err != nil {
+			return ctx, err
+		}
+	}
+
+	mountedTS := ts.forMount(mountedPath)
+	return withEnvironment(ctx, fmt.Sprintf("CERT_DIR=%s", mountedTS.certsD())), nil
+}
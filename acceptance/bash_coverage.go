@@ -26,9 +26,16 @@ const (
 var containerToSource = map[string]string{
 	"/usr/local/bin/create-archive":     "create-oci.sh",
 	"/usr/local/bin/use-archive":        "use-oci.sh",
+	"/usr/local/bin/index-archive":      "index-oci.sh",
+	"/usr/local/bin/inspect-archive":    "inspect-oci.sh",
+	"/usr/local/bin/verify-archive":     "verify-oci.sh",
+	"/usr/local/bin/diff-archive":       "diff-oci.sh",
 	"/usr/local/bin/entrypoint":         "entrypoint.sh",
 	"/usr/local/bin/oras_opts.sh":       "oras_opts.sh",
+	"/usr/local/bin/jobs.sh":            "jobs.sh",
+	"/usr/local/bin/artifacts.sh":       "artifacts.sh",
 	"/usr/local/bin/select-oci-auth.sh": "select-oci-auth.sh",
+	"/usr/local/bin/redact.sh":          "redact.sh",
 }
 
 func initBashCoverage() error {
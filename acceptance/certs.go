@@ -4,15 +4,25 @@ import (
 	"crypto/ecdsa"
 	"crypto/elliptic"
 	"crypto/rand"
+	"crypto/sha256"
 	"crypto/x509"
 	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
 	"encoding/pem"
+	"errors"
 	"math/big"
 	"os"
 	"time"
 )
 
-func generateSelfSignedCert(cert, key string) error {
+// generateSelfSignedCert creates a self-signed certificate for the registry host, by default for
+// server authentication, e.g. client certificates are created by passing x509.ExtKeyUsageClientAuth.
+func generateSelfSignedCert(cert, key string, usages ...x509.ExtKeyUsage) error {
+	if len(usages) == 0 {
+		usages = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+	}
+
 	// Generate a private key
 	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
 	if err != nil {
@@ -37,7 +47,7 @@ func generateSelfSignedCert(cert, key string) error {
 		NotAfter:  notAfter,
 
 		KeyUsage:              x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature,
-		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		ExtKeyUsage:           usages,
 		BasicConstraintsValid: true,
 	}
 
@@ -75,3 +85,97 @@ func generateSelfSignedCert(cert, key string) error {
 
 	return nil
 }
+
+// generateSigningKeyPair creates an ECDSA key pair for signing artifacts, the private key is saved
+// unencrypted in the PKCS #8 form and the public key in the PKIX form, the same form cosign uses.
+func generateSigningKeyPair(key, pub string) error {
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+
+	privBytes, err := x509.MarshalPKCS8PrivateKey(priv)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(key, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: privBytes}), 0600); err != nil {
+		return err
+	}
+
+	pubBytes, err := x509.MarshalPKIXPublicKey(&priv.PublicKey)
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(pub, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pubBytes}), 0644)
+}
+
+// registryToken mints a registry bearer token, an ES256 signed JWT, granting pull and push access to
+// the given repository. It is signed with the key of the given certificate, which the registry
+// trusts via REGISTRY_AUTH_TOKEN_ROOTCERTBUNDLE, and carries the certificate in the x5c header so
+// the registry can find the key.
+func registryToken(cert, key, issuer, service, repository string) (string, error) {
+	certPEM, err := os.ReadFile(cert)
+	if err != nil {
+		return "", err
+	}
+	certBlock, _ := pem.Decode(certPEM)
+	if certBlock == nil {
+		return "", errors.New("no certificate found")
+	}
+
+	keyPEM, err := os.ReadFile(key)
+	if err != nil {
+		return "", err
+	}
+	keyBlock, _ := pem.Decode(keyPEM)
+	if keyBlock == nil {
+		return "", errors.New("no private key found")
+	}
+	priv, err := x509.ParseECPrivateKey(keyBlock.Bytes)
+	if err != nil {
+		return "", err
+	}
+
+	header, err := json.Marshal(map[string]any{
+		"typ": "JWT",
+		"alg": "ES256",
+		"x5c": []string{base64.StdEncoding.EncodeToString(certBlock.Bytes)},
+	})
+	if err != nil {
+		return "", err
+	}
+
+	now := time.Now()
+	claims, err := json.Marshal(map[string]any{
+		"iss": issuer,
+		"sub": "trusted-artifacts",
+		"aud": service,
+		"iat": now.Unix(),
+		"nbf": now.Add(-time.Minute).Unix(),
+		"exp": now.Add(time.Hour).Unix(),
+		"jti": now.Format(time.RFC3339Nano),
+		"access": []map[string]any{
+			{"type": "repository", "name": repository, "actions": []string{"pull", "push"}},
+		},
+	})
+	if err != nil {
+		return "", err
+	}
+
+	enc := base64.RawURLEncoding
+	signed := enc.EncodeToString(header) + "." + enc.EncodeToString(claims)
+
+	digest := sha256.Sum256([]byte(signed))
+	r, s, err := ecdsa.Sign(rand.Reader, priv, digest[:])
+	if err != nil {
+		return "", err
+	}
+
+	// JWS uses the fixed size concatenation of r and s rather than the ASN.1 form
+	signature := make([]byte, 64)
+	r.FillBytes(signature[:32])
+	s.FillBytes(signature[32:])
+
+	return signed + "." + enc.EncodeToString(signature), nil
+}
@@ -38,6 +38,7 @@ const (
 	artifactContainer = "trusted-artifacts"
 	registryPort      = "5000"
 	registryImage     = "docker.io/library/registry:2.8.3"
+	tokenServiceHost  = "host.docker.internal"
 )
 
 func init() {
@@ -48,7 +49,9 @@ func init() {
 	}
 }
 
-func runRegistry(ctx context.Context, binds []string, certs, key string) (string, error) {
+// runRegistry runs the registry serving TLS with the given certificate and key, the given
+// environment variables are added to its configuration, e.g. to enable authentication.
+func runRegistry(ctx context.Context, binds []string, certs, key string, env ...string) (string, error) {
 	user, err := user.Current()
 	if err != nil {
 		return "", err
@@ -89,10 +92,10 @@ func runRegistry(ctx context.Context, binds []string, certs, key string) (string
 		ctx,
 		&container.Config{
 			Hostname: registryHost,
-			Env: []string{
+			Env: append([]string{
 				fmt.Sprintf("REGISTRY_HTTP_TLS_CERTIFICATE=%s", certs),
 				fmt.Sprintf("REGISTRY_HTTP_TLS_KEY=%s", key),
-			},
+			}, env...),
 			Image: registryImage,
 			User:  user.Uid,
 			ExposedPorts: nat.PortSet{
@@ -124,10 +127,8 @@ func runRegistry(ctx context.Context, binds []string, certs, key string) (string
 	ctxWait, cancel := context.WithTimeout(ctx, waitTimeout)
 	defer cancel()
 
-	transport := http.DefaultTransport.(*http.Transport).Clone()
-	transport.TLSClientConfig.InsecureSkipVerify = true
 	client := http.Client{
-		Transport: transport,
+		Transport: registryTransport(ctx),
 	}
 
 	for {
@@ -148,6 +149,36 @@ func runRegistry(ctx context.Context, binds []string, certs, key string) (string
 	return cont.ID, nil
 }
 
+// stopRegistry stops the registry container without removing it, so it can still be cleaned up at
+// the end of the scenario.
+func stopRegistry(ctx context.Context, containerID string) error {
+	return containerClient.ContainerStop(ctx, containerID, container.StopOptions{})
+}
+
+// removeRegistry removes the registry container together with its storage, leaving the other bind
+// mounts in place, so that another registry can be run in the scenario.
+func removeRegistry(ctx context.Context, containerID string) error {
+	containerJSON, err := containerClient.ContainerInspect(ctx, containerID)
+	if err != nil {
+		return fmt.Errorf("inspecting container: %w", err)
+	}
+
+	if err := stopContainer(ctx, containerID); err != nil {
+		return fmt.Errorf("removing container: %w", err)
+	}
+
+	for _, bind := range containerJSON.HostConfig.Binds {
+		hostPath, rest, _ := strings.Cut(bind, ":")
+		if strings.HasPrefix(rest, "/var/lib/registry:") {
+			if err := os.RemoveAll(hostPath); err != nil {
+				return fmt.Errorf("removing registry storage %s: %w", hostPath, err)
+			}
+		}
+	}
+
+	return nil
+}
+
 func stopContainer(ctx context.Context, containerID string) error {
 	return containerClient.ContainerRemove(ctx, containerID, container.RemoveOptions{Force: true})
 }
@@ -201,6 +232,8 @@ func runContainer(ctx context.Context, cmd, binds []string, cert string) (contex
 		&container.HostConfig{
 			Binds:       binds,
 			NetworkMode: container.NetworkMode(networkName),
+			// the token service runs on the host, see startTokenService
+			ExtraHosts: []string{tokenServiceHost + ":host-gateway"},
 		},
 		&network.NetworkingConfig{},
 		&ocispec.Platform{},
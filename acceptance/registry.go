@@ -0,0 +1,207 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/static"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+)
+
+// registryRepository returns the repository the artifacts are pushed to, as seen from the host
+// running the tests.
+func registryRepository() (name.Repository, error) {
+	// Using 0.0.0.0 instead of localhost makes sure HTTPS is used to connect to the registry.
+	return name.NewRepository(fmt.Sprintf("0.0.0.0:%s/%s", registryPort, artifactContainer))
+}
+
+// registryTransport returns the transport to connect to the registry from the host running the
+// tests, presenting the client certificate of the scenario, if the registry requires one.
+func registryTransport(ctx context.Context) *http.Transport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig.InsecureSkipVerify = true
+	if cert, ok := ctx.Value(clientCertKey).(tls.Certificate); ok {
+		transport.TLSClientConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return transport
+}
+
+func registryOptions(ctx context.Context) []remote.Option {
+	return []remote.Option{remote.WithContext(ctx), remote.WithTransport(registryTransport(ctx))}
+}
+
+// artifactTag returns the tag included in the given artifact URI, e.g. "tag" for
+// "oci:registry/repo:tag@sha256:...".
+func artifactTag(uri string) (string, error) {
+	ref, _, _ := strings.Cut(strings.TrimPrefix(uri, "oci:"), "@")
+	_, repoAndTag, _ := strings.Cut(ref, "/")
+	_, tag, found := strings.Cut(repoAndTag, ":")
+	if !found {
+		return "", fmt.Errorf("the artifact %q is not tagged", uri)
+	}
+
+	return tag, nil
+}
+
+// artifactManifest fetches the manifest referenced by the tag included in the given artifact URI.
+func artifactManifest(ctx context.Context, uri string) (*v1.Manifest, error) {
+	repo, err := registryRepository()
+	if err != nil {
+		return nil, err
+	}
+
+	tag, err := artifactTag(uri)
+	if err != nil {
+		return nil, err
+	}
+
+	img, err := remote.Image(repo.Tag(tag), registryOptions(ctx)...)
+	if err != nil {
+		return nil, fmt.Errorf("fetching image %s: %w", tag, err)
+	}
+
+	manifest, err := img.Manifest()
+	if err != nil {
+		return nil, fmt.Errorf("fetching manifest %s: %w", tag, err)
+	}
+
+	return manifest, nil
+}
+
+// artifactLayer finds the layer descriptor of the artifact with the given URI in the manifest
+// referenced by the tag included in the URI.
+func artifactLayer(ctx context.Context, uri string) (v1.Descriptor, error) {
+	manifest, err := artifactManifest(ctx, uri)
+	if err != nil {
+		return v1.Descriptor{}, err
+	}
+
+	_, digest, _ := strings.Cut(uri, "@")
+	for _, layer := range manifest.Layers {
+		if layer.Digest.String() == digest {
+			return layer, nil
+		}
+	}
+
+	return v1.Descriptor{}, fmt.Errorf("no layer %s found in the manifest of %s", digest, uri)
+}
+
+// registryTags lists the tags in the test repository.
+func registryTags(ctx context.Context) ([]string, error) {
+	repo, err := registryRepository()
+	if err != nil {
+		return nil, err
+	}
+
+	return remote.List(repo, registryOptions(ctx)...)
+}
+
+// pushArchive uploads the given gzip compressed archive as a blob to the test repository, bypassing
+// create-oci.sh, and returns its digest.
+func pushArchive(ctx context.Context, archive []byte) (v1.Hash, error) {
+	repo, err := registryRepository()
+	if err != nil {
+		return v1.Hash{}, err
+	}
+
+	layer := static.NewLayer(archive, types.OCILayer)
+	if err := remote.WriteLayer(repo, layer, registryOptions(ctx)...); err != nil {
+		return v1.Hash{}, fmt.Errorf("pushing archive: %w", err)
+	}
+
+	return layer.Digest()
+}
+
+// cosignSignatureType is the artifact type of the cosign signatures attached as referrers.
+const cosignSignatureType = "application/vnd.dev.cosign.artifact.sig.v1+json"
+
+// referrersTag matches the tags of the indexes listing the referrers of a manifest, used with
+// registries that don't support the referrers API.
+var referrersTag = regexp.MustCompile(`^sha256-[0-9a-f]{64}$`)
+
+// provenanceType is the artifact type of the in-toto statements attached as referrers.
+const provenanceType = "application/vnd.in-toto+json"
+
+// referrerLayer is the content and the annotations of a layer of a referrer, along with the
+// annotations of the referrer's manifest.
+type referrerLayer struct {
+	content             []byte
+	annotations         map[string]string
+	manifestAnnotations map[string]string
+}
+
+// artifactReferrers returns the digest of the manifest referenced by the tag included in the given
+// artifact URI, and the layers of the referrers of that manifest with the given artifact type.
+func artifactReferrers(ctx context.Context, uri, artifactType string) (v1.Hash, []referrerLayer, error) {
+	repo, err := registryRepository()
+	if err != nil {
+		return v1.Hash{}, nil, err
+	}
+
+	tag, err := artifactTag(uri)
+	if err != nil {
+		return v1.Hash{}, nil, err
+	}
+
+	desc, err := remote.Head(repo.Tag(tag), registryOptions(ctx)...)
+	if err != nil {
+		return v1.Hash{}, nil, fmt.Errorf("resolving tag %s: %w", tag, err)
+	}
+
+	referrers, err := remote.Referrers(repo.Digest(desc.Digest.String()), registryOptions(ctx)...)
+	if err != nil {
+		return v1.Hash{}, nil, fmt.Errorf("listing referrers of %s: %w", desc.Digest, err)
+	}
+
+	index, err := referrers.IndexManifest()
+	if err != nil {
+		return v1.Hash{}, nil, err
+	}
+
+	var layers []referrerLayer
+	for _, referrer := range index.Manifests {
+		if referrer.ArtifactType != artifactType {
+			continue
+		}
+
+		img, err := remote.Image(repo.Digest(referrer.Digest.String()), registryOptions(ctx)...)
+		if err != nil {
+			return v1.Hash{}, nil, fmt.Errorf("fetching referrer %s: %w", referrer.Digest, err)
+		}
+
+		manifest, err := img.Manifest()
+		if err != nil {
+			return v1.Hash{}, nil, err
+		}
+
+		for _, l := range manifest.Layers {
+			layer, err := img.LayerByDigest(l.Digest)
+			if err != nil {
+				return v1.Hash{}, nil, err
+			}
+
+			rc, err := layer.Compressed()
+			if err != nil {
+				return v1.Hash{}, nil, err
+			}
+			content, err := io.ReadAll(rc)
+			_ = rc.Close()
+			if err != nil {
+				return v1.Hash{}, nil, fmt.Errorf("reading referrer layer %s: %w", l.Digest, err)
+			}
+
+			layers = append(layers, referrerLayer{content: content, annotations: l.Annotations, manifestAnnotations: manifest.Annotations})
+		}
+	}
+
+	return desc.Digest, layers, nil
+}
@@ -52,6 +52,18 @@ func (ts *testState) restoredDir() string {
 	return filepath.Join(ts.contextDir, "restored")
 }
 
+func (ts *testState) storeDir() string {
+	return filepath.Join(ts.contextDir, "store")
+}
+
+func (ts *testState) layoutDir() string {
+	return filepath.Join(ts.contextDir, "layout")
+}
+
+func (ts *testState) cacheDir() string {
+	return filepath.Join(ts.contextDir, "cache")
+}
+
 func (ts *testState) certsDir() string {
 	return filepath.Join(ts.contextDir, "certs")
 }
@@ -72,6 +84,27 @@ func (ts *testState) decoyKey() string {
 	return filepath.Join(ts.certsDir(), "decoy-ca.key")
 }
 
+func (ts *testState) tokenCert() string {
+	return filepath.Join(ts.certsDir(), "token.crt")
+}
+
+func (ts *testState) tokenKey() string {
+	return filepath.Join(ts.certsDir(), "token.key")
+}
+
+func (ts *testState) clientCert() string {
+	return filepath.Join(ts.certsDir(), "client.cert")
+}
+
+func (ts *testState) clientKey() string {
+	return filepath.Join(ts.certsDir(), "client.key")
+}
+
+// certsD is the containers-certs.d(5) directory with the TLS configuration of the registries.
+func (ts *testState) certsD() string {
+	return filepath.Join(ts.contextDir, "certs.d")
+}
+
 func (ts *testState) systemCABundle() string {
 	return filepath.Join(ts.certsDir(), "system-ca-bundle.crt")
 }
@@ -0,0 +1,638 @@
+#!/bin/bash
+# Fetches, validates, indexes and compares the archives of trusted artifacts, sourced by the
+# scripts implementing the operations.
+#
+# The artifacts are referenced by their URI, as written to the results by create-oci.sh, e.g.
+# oci:registry/org/repo:tag@sha256:123, oci-layout:/workspace/layout@sha256:123 or
+# file:/workspace/artifacts@sha256:123.
+
+# <type><mode> <uid>/<gid> <size> <date> <time> "<name>"[ -> "<symlink target>"|link to "<hard link target>"]
+# as listed by tar --list --verbose --quoting-style=c. The size of device files is listed as
+# "<major>, <minor>".
+member_re='^(.)(.{9})[^ ]* +[^ ]+ +([0-9]+|[0-9]+, *[0-9]+) +[^ ]+ +[^ ]+ +"((\\.|[^\\"])*)"( (->|link to) "((\\.|[^\\"])*)")?$'
+
+# Prints the tar option to decompress the given archive with, based on the magic number the archive
+# starts with. Nothing is printed for uncompressed archives.
+decompress_opt() {
+    local magic
+    magic="$(head --bytes=4 "$1" | od --address-radix=n --format=x1 | tr -d ' \n')"
+    case "${magic}" in
+        1f8b*)
+            echo --gzip
+            ;;
+        28b52ffd)
+            echo --zstd
+            ;;
+    esac
+}
+
+# Succeeds if the given relative path, resolved lexically, points outside of the directory it is
+# relative to.
+path_escapes() {
+    local depth=0 component components
+    IFS=/ read -ra components <<< "$1"
+    for component in "${components[@]}"; do
+        case "${component}" in
+            ''|.)
+                ;;
+            ..)
+                depth=$((depth - 1))
+                if [[ ${depth} -lt 0 ]]; then
+                    return 0
+                fi
+                ;;
+            *)
+                depth=$((depth + 1))
+                ;;
+        esac
+    done
+    return 1
+}
+
+# Lists the members of the given archive into the given file, one per line in the format matched by
+# member_re. Names are C quoted so that any special characters, e.g. new lines, are escaped. Names
+# are listed verbatim, tar would otherwise strip the leading / and ../ from them.
+list_archive() {
+    local archive="$1" decompress="$2" listing="$3"
+
+    LC_ALL=C tar --list --verbose --quoting-style=c --numeric-owner --absolute-names \
+        ${decompress:+"${decompress}"} --file "${archive}" > "${listing}"
+}
+
+# Succeeds if the given relative path, resolved lexically, goes through one of the symbolic links in
+# the symlinks associative array of the caller, and sets the variable with the given name to that
+# symbolic link. The last component of the path is not followed, only the directories leading to it.
+# Runs in the current shell, as it is called for every archive member.
+path_through_symlink() {
+    local -n through="$2"
+    local prefix="" component components i
+    IFS=/ read -ra components <<< "$1"
+    for ((i = 0; i < ${#components[@]}; i++)); do
+        if [[ -n "${prefix}" && -n "${symlinks[${prefix}]:-}" ]]; then
+            through="${prefix}"
+            return 0
+        fi
+        component="${components[i]}"
+        case "${component}" in
+            ''|.)
+                ;;
+            ..)
+                if [[ "${prefix}" == */* ]]; then
+                    prefix="${prefix%/*}"
+                else
+                    prefix=""
+                fi
+                ;;
+            *)
+                prefix="${prefix:+${prefix}/}${component}"
+                ;;
+        esac
+    done
+    return 1
+}
+
+# Validates all members of the given archive before any of them is extracted. Prints the first
+# violation found and fails if a member has an absolute path or a ".." component, is a link
+# pointing outside of the destination, or would be written through a symbolic link in the archive.
+# Link targets going through a symbolic link in the archive are refused as well, as they can't be
+# resolved lexically, e.g. b -> a/.. with a -> . points outside of the destination. The symbolic
+# links are collected first, so the order of the members in the archive does not matter.
+validate_archive() {
+    local archive="$1" decompress="$2"
+    local listing="${archive}.members"
+    local line type member target parent via i
+    local -a types=() members=() targets=()
+    local -A symlinks=()
+
+    list_archive "${archive}" "${decompress}" "${listing}" || return 1
+
+    while IFS= read -r line; do
+        if [[ ! "${line}" =~ ${member_re} ]]; then
+            echo "ERROR: unable to parse the archive member: ${line}"
+            return 1
+        fi
+        type="${BASH_REMATCH[1]}"
+        member="${BASH_REMATCH[4]}"
+        target="${BASH_REMATCH[8]}"
+
+        if [[ "${member}" == /* ]]; then
+            echo "ERROR: archive member has an absolute path: ${member}"
+            return 1
+        fi
+
+        if [[ "/${member}/" == */../* ]]; then
+            echo "ERROR: archive member path contains \"..\": ${member}"
+            return 1
+        fi
+
+        while [[ "${member}" == ./* ]]; do
+            member="${member#./}"
+        done
+        member="${member%/}"
+
+        case "${type}" in
+            l)
+                if [[ "${target}" == /* ]] || path_escapes "$(dirname "${member}")/${target}"; then
+                    echo "ERROR: archive member is a symbolic link pointing outside of the destination: ${member} -> ${target}"
+                    return 1
+                fi
+                symlinks["${member}"]=1
+                ;;
+            h)
+                if [[ "${target}" == /* ]] || path_escapes "${target}"; then
+                    echo "ERROR: archive member is a hard link pointing outside of the destination: ${member} link to ${target}"
+                    return 1
+                fi
+                ;;
+        esac
+
+        types+=("${type}")
+        members+=("${member}")
+        targets+=("${target}")
+    done < "${listing}"
+
+    for i in "${!members[@]}"; do
+        member="${members[i]}"
+        target="${targets[i]}"
+
+        # none of the parent directories of the member may be a symbolic link from the archive
+        if path_through_symlink "${member}" via; then
+            echo "ERROR: archive member would be written through a symbolic link: ${member} (via ${via})"
+            return 1
+        fi
+
+        case "${types[i]}" in
+            l)
+                parent=""
+                if [[ "${member}" == */* ]]; then
+                    parent="${member%/*}"
+                fi
+                if path_through_symlink "${parent}/${target}" via; then
+                    echo "ERROR: archive member is a symbolic link pointing through a symbolic link: ${member} -> ${target} (via ${via})"
+                    return 1
+                fi
+                ;;
+            h)
+                if path_through_symlink "${target}" via; then
+                    echo "ERROR: archive member is a hard link pointing through a symbolic link: ${member} link to ${target} (via ${via})"
+                    return 1
+                fi
+                ;;
+        esac
+    done
+}
+
+# Succeeds if the content of the given file matches the given sha256 digest.
+matches_digest() {
+    echo "${2#sha256:}  $1" | sha256sum --check --status
+}
+
+# Prints the repository, or the OCI image layout or store directory, of the artifact with the given
+# URI, without the tag and the digest.
+artifact_repo() {
+    local ref="${1#*:}"
+    ref="${ref%@*}"
+    if [[ "${1/:*}" != file && "${ref##*/}" == *:* ]]; then
+        ref="${ref%:*}"
+    fi
+    echo -n "${ref}"
+}
+
+# Sets the array with the given name to the oras options selecting where the artifact with the given
+# URI is read from. The credentials for the registry are written to the given directory, the TLS
+# configuration of the registry is taken from its certs.d directory, see registry_tls_opts in
+# oras_opts.sh.
+artifact_target_opts() {
+    local uri="$1" work="$2"
+    local -n opts="$3"
+    local authfile registry
+
+    case "${uri/:*}" in
+        oci)
+            authfile=$(mktemp --tmpdir="${work}" "auth-XXXXXX.json")
+            select-oci-auth.sh "${uri#*:}" > "${authfile}"
+            opts=(--registry-config "${authfile}")
+            registry="${uri#*:}"
+            registry_tls_opts "${registry%%/*}" "${work}" "$3"
+            ;;
+        oci-layout)
+            opts=(--oci-layout)
+            ;;
+        *)
+            opts=()
+            ;;
+    esac
+}
+
+# Fetches the archive of the artifact with the given URI to the given path. The remaining arguments
+# are the oras options set by artifact_target_opts. The archive is not verified against the digest,
+# that is left to the caller.
+fetch_archive() {
+    local uri="$1" archive="$2"
+    shift 2
+    local digest="${uri##*@}"
+
+    case "${uri/:*}" in
+        oci)
+            retry oras blob fetch "${oras_opts[@]}" "$@" "${uri#*:}" --output "${archive}"
+            ;;
+        file)
+            # stored by create-oci.sh under <directory>/sha256/<digest>
+            cp "$(artifact_repo "${uri}")/sha256/${digest#sha256:}" "${archive}"
+            ;;
+        oci-layout)
+            # blobs are always stored under <layout>/blobs/sha256/<digest>
+            cp "$(artifact_repo "${uri}")/blobs/sha256/${digest#sha256:}" "${archive}"
+            ;;
+        *)
+            echo "ERROR: unsupported archive type: ${uri/:*}"
+            return 1
+            ;;
+    esac
+}
+
+# Sets the variable with the given name to the octal mode of the given permissions, e.g. rwxr-xr-x,
+# as listed by tar. Runs in the current shell, as it is called for every archive member.
+octal_mode() {
+    local permissions="$1" bits=0 i
+    local -n octal="$2"
+
+    for ((i = 0; i < 9; i++)); do
+        case "${permissions:i:1}" in
+            -|S|T)
+                ;;
+            *)
+                bits=$((bits | 1 << (8 - i)))
+                ;;
+        esac
+    done
+    case "${permissions:2:1}" in s|S) bits=$((bits | 04000)) ;; esac
+    case "${permissions:5:1}" in s|S) bits=$((bits | 02000)) ;; esac
+    case "${permissions:8:1}" in t|T) bits=$((bits | 01000)) ;; esac
+
+    printf -v octal '%04o' "${bits}"
+}
+
+# Sets the variable with the given name to the given member name, as listed by tar
+# --quoting-style=c without the surrounding quotes, with the escape sequences decoded and the
+# leading ./ and trailing / removed.
+decode_member() {
+    local -n decoded="$2"
+
+    # %b decodes all the escape sequences used by tar apart from \"
+    printf -v decoded '%b' "${1//\\\"/\"}"
+    while [[ "${decoded}" == ./* ]]; do
+        decoded="${decoded#./}"
+    done
+    if [[ "${decoded}" == . ]]; then
+        decoded=""
+    fi
+    decoded="${decoded%/}"
+}
+
+# Prints the JSON index of the files in the given archive of the artifact with the given digest. The
+# index lists the path, type and octal mode of every member of the archive, the size and sha256
+# digest of regular files and the target of symbolic links:
+#   {"artifact": "sha256:...", "files": [{"path": "a/b", "type": "file", "mode": "0644", ...}, ...]}
+# Hard links are listed as the regular files they link to. The files are sorted by path.
+index_archive() {
+    local archive="$1" digest="$2"
+    local listing="${archive}.index-members" tree="${archive}.index-tree"
+    local records="${archive}.index-records"
+    local decompress line type permissions mode size member target sha256
+    local -A file_sizes=() file_checksums=()
+
+    decompress="$(decompress_opt "${archive}")"
+    list_archive "${archive}" "${decompress}" "${listing}" || return 1
+
+    # the regular files are extracted once and hashed in a single pass, rather than starting a
+    # process for each of them. Only the regular files are needed, anything else that can't be
+    # extracted, e.g. device files when not running as root, is reported missing below if it is
+    # a regular file after all
+    mkdir "${tree}"
+    tar -C "${tree}" --extract --no-same-owner --no-same-permissions ${decompress:+"${decompress}"} \
+        --file "${archive}" 2> /dev/null || true
+    # the extracted copy is only read, files and directories without read permissions included
+    chmod -R u+rX "${tree}"
+    while IFS= read -r line; do
+        sha256="${line:0:64}"
+        member="${line:66}"
+        if [[ "${line}" == \\* ]]; then
+            # names with a backslash or a new line are escaped, and the line starts with a backslash
+            sha256="${line:1:64}"
+            printf -v member '%b' "${line:67}"
+        fi
+        file_checksums["${member#./}"]="${sha256}"
+    done < <(cd "${tree}" && find . -type f -exec sha256sum {} +)
+    rm -rf "${tree}"
+
+    while IFS= read -r line; do
+        if [[ ! "${line}" =~ ${member_re} ]]; then
+            echo "ERROR: unable to parse the archive member: ${line}" >&2
+            return 1
+        fi
+        type="${BASH_REMATCH[1]}"
+        permissions="${BASH_REMATCH[2]}"
+        size="${BASH_REMATCH[3]}"
+        decode_member "${BASH_REMATCH[4]}" member
+        decode_member "${BASH_REMATCH[8]}" target
+        octal_mode "${permissions}" mode
+        sha256=""
+
+        if [[ -z "${member}" ]]; then
+            # the root of the archive
+            continue
+        fi
+
+        case "${type}" in
+            -)
+                type=file
+                if [[ -z "${file_checksums[${member}]+set}" ]]; then
+                    echo "ERROR: unable to index the regular file ${member} of the archive" >&2
+                    return 1
+                fi
+                sha256="${file_checksums[${member}]}"
+                file_sizes["${member}"]="${size}"
+                ;;
+            h)
+                if [[ -z "${file_sizes[${target}]+set}" ]]; then
+                    echo "ERROR: archive member ${member} links to ${target}, which is not a regular file in the archive" >&2
+                    return 1
+                fi
+                type=file
+                size="${file_sizes[${target}]}"
+                sha256="${file_checksums[${target}]}"
+                ;;
+            d)
+                type=directory
+                ;;
+            l)
+                type=symlink
+                ;;
+            c)
+                type=char-device
+                ;;
+            b)
+                type=block-device
+                ;;
+            p)
+                type=fifo
+                ;;
+            *)
+                type=other
+                ;;
+        esac
+
+        printf '%s\0' "${member}" "${type}" "${mode}" "${size}" "${sha256}" "${target}"
+    done < "${listing}" > "${records}"
+
+    # the records are read with --rawfile, --raw-input does not preserve the NUL separators
+    jq --null-input --rawfile records "${records}" --arg artifact "${digest}" '
+        $records | split("\u0000")[:-1] as $fields
+        | {
+            artifact: $artifact,
+            files: [
+                range(0; $fields | length; 6) as $i
+                | {path: $fields[$i], type: $fields[$i + 1], mode: $fields[$i + 2]}
+                + if $fields[$i + 1] == "file" then
+                    {size: ($fields[$i + 3] | tonumber), sha256: $fields[$i + 4]}
+                elif $fields[$i + 1] == "symlink" then
+                    {target: $fields[$i + 5]}
+                else
+                    {}
+                end
+            ] | sort_by(.path)
+        }'
+}
+
+# Fetches the manifest containing the artifact with the given URI, found via the tag in the URI, to
+# the given path. The remaining arguments are the oras options set by artifact_target_opts. Fails if
+# the artifact is not tagged, is stored in a directory or the manifest does not contain it.
+fetch_manifest() {
+    local uri="$1" manifest="$2"
+    shift 2
+    local ref="${uri#*:}"
+    ref="${ref%@*}"
+
+    if [[ "${uri/:*}" == file || "${ref}" == "$(artifact_repo "${uri}")" ]]; then
+        # not tagged
+        return 1
+    fi
+
+    oras manifest fetch "${oras_opts[@]}" "$@" "${ref}" --output "${manifest}" 2> /dev/null || return 1
+    jq --exit-status --arg digest "${uri##*@}" 'any(.layers[]; .digest == $digest)' "${manifest}" > /dev/null 2>&1
+}
+
+# Fetches the file index stored alongside the artifact with the given URI, as created by
+# create-oci.sh, to the given path. The remaining arguments are the oras options set by
+# artifact_target_opts. In a repository or an OCI image layout the index is a layer of the manifest
+# containing the artifact, see fetch_manifest, so untagged artifacts have no index to fetch. In a
+# store directory the index is stored under <directory>/index/<digest>.json. Either way the index
+# is not tied to the digest of the artifact, it can be trusted no more than the tag or the directory
+# it is found through. Fails if no index of the artifact is found.
+fetch_index() {
+    local uri="$1" index="$2"
+    shift 2
+    local digest="${uri##*@}" repo index_digest
+
+    repo="$(artifact_repo "${uri}")"
+    case "${uri/:*}" in
+        file)
+            cp "${repo}/index/${digest#sha256:}.json" "${index}" 2> /dev/null || return 1
+            ;;
+        *)
+            fetch_manifest "${uri}" "${index}.manifest" "$@" || return 1
+
+            index_digest="$(jq --raw-output --arg digest "${digest}" 'first(.layers[]
+                | select(.annotations["dev.konflux-ci.trusted-artifacts.index-of"] == $digest)
+                | .digest) // empty' "${index}.manifest")"
+            if [[ -z "${index_digest}" ]]; then
+                return 1
+            fi
+
+            oras blob fetch "${oras_opts[@]}" "$@" "${repo}@${index_digest}" --output "${index}" 2> /dev/null \
+                && matches_digest "${index}" "${index_digest}" || return 1
+            ;;
+    esac
+
+    # an index of another artifact is of no use
+    jq --exit-status --arg digest "${digest}" '.artifact == $digest' "${index}" > /dev/null 2>&1
+}
+
+# Fetches the archive of the artifact with the given URI into the given directory, verifies it
+# against the digest and writes the index of its files to the given path. The remaining arguments
+# are the oras options set by artifact_target_opts.
+index_artifact_archive() {
+    local uri="$1" index="$2" work="$3"
+    shift 3
+    local archive="${work}/archive"
+
+    fetch_archive "${uri}" "${archive}" "$@" >&2 || return 1
+    if ! matches_digest "${archive}" "${uri##*@}"; then
+        echo "ERROR: artifact ${uri#*:} does not match its digest" >&2
+        return 1
+    fi
+
+    index_archive "${archive}" "${uri##*@}" > "${index}"
+}
+
+# Writes the index of the files in the artifact with the given URI to the given path. The index
+# stored alongside the artifact is used if there is one, otherwise the archive is fetched into the
+# given directory and indexed, see index_artifact_archive. The remaining arguments are the oras
+# options set by artifact_target_opts.
+artifact_index() {
+    local uri="$1" index="$2" work="$3"
+    shift 3
+
+    if fetch_index "${uri}" "${index}" "$@"; then
+        return 0
+    fi
+
+    index_artifact_archive "${uri}" "${index}" "${work}" "$@"
+}
+
+# Appends the patterns listed in the .trusted-artifacts-ignore file in the given directory, if there
+# is one, to the array with the given name. The file uses a subset of the gitignore syntax: blank
+# lines and lines starting with # are ignored, negated patterns (!) are not supported.
+read_ignore_file() {
+    local ignore_file="$1/.trusted-artifacts-ignore"
+    local -n ignore_patterns="$2"
+    local pattern
+
+    if [ ! -f "${ignore_file}" ]; then
+        return
+    fi
+
+    while IFS= read -r pattern || [[ -n "${pattern}" ]]; do
+        # trim trailing whitespace, including carriage returns
+        pattern="${pattern%"${pattern##*[![:space:]]}"}"
+        if [[ -z "${pattern}" || "${pattern}" == \#* ]]; then
+            continue
+        fi
+        if [[ "${pattern}" == \!* ]]; then
+            echo "WARN: negated patterns are not supported, ignoring: ${pattern}" >&2
+            continue
+        fi
+        ignore_patterns+=("${pattern#\\}")
+    done < "${ignore_file}"
+}
+
+# Converts the given gitignore-like pattern into tar options excluding the matching files and
+# appends them to the exclude_opts array.
+add_exclude() {
+    local pattern="$1" anchored="" variant prefix rest before after i
+    local -a variants=() opts=()
+
+    # tar cannot tell directories from files when matching, a trailing slash or /** have the same
+    # effect as excluding the path itself
+    pattern="${pattern%/}"
+    pattern="${pattern%/\*\*}"
+
+    if [[ "${pattern}" == \*\*/* ]]; then
+        # the same as matching at any depth
+        pattern="${pattern#\*\*/}"
+    elif [[ "${pattern}" == */* ]]; then
+        # anchored to the root of the source directory
+        anchored=1
+        pattern="${pattern#/}"
+    fi
+
+    # a /**/ in the middle also matches no directory at all, e.g. a/**/b matches a/b, while the *
+    # tar matches it with needs at least one, so every combination of them collapsed to a / is
+    # excluded as well
+    variants=("${pattern}")
+    for ((i = 0; i < ${#variants[@]}; i++)); do
+        prefix=""
+        rest="${variants[i]}"
+        while [[ "${rest}" == */\*\*/* ]]; do
+            before="${rest%%/\*\*/*}"
+            after="${rest#*/\*\*/}"
+            variant="${prefix}${before}/${after}"
+            if [[ " ${variants[*]} " != *" ${variant} "* ]]; then
+                variants+=("${variant}")
+            fi
+            prefix="${prefix}${before}/**"
+            rest="/${after}"
+        done
+    done
+
+    for variant in "${variants[@]}"; do
+        opts=("--exclude=${variant}")
+        if [[ -n "${anchored}" ]]; then
+            # archive member names start with ./
+            opts=(--anchored "--exclude=./${variant}" --no-anchored)
+        fi
+        if [[ "${variant}" == */* && "${variant}" != *\*\** ]]; then
+            # a * does not match a / either, e.g. a/*.txt does not match a/b/c.txt. Patterns with a **
+            # are left to the tar default, where ** and * alike match any number of directories
+            opts=(--no-wildcards-match-slash "${opts[@]}" --wildcards-match-slash)
+        fi
+        exclude_opts+=("${opts[@]}")
+    done
+}
+
+# Prints the JSON index of the files in the given directory, in the same form as index_archive,
+# leaving out the files matching the given patterns, see add_exclude. The directory is archived in
+# the given working directory the same way create-oci.sh archives it, and the archive is indexed.
+index_directory() {
+    local directory="$1" work="$2"
+    shift 2
+    local archive pattern
+    local -a exclude_opts=()
+
+    for pattern in "$@"; do
+        add_exclude "${pattern}"
+    done
+
+    archive="$(mktemp --tmpdir="${work}" directory-XXXXXX.tar)"
+    tar --create --file "${archive}" "${exclude_opts[@]}" --directory="${directory}" . || return 1
+    index_archive "${archive}" ""
+}
+
+# Prints the differences between the files in the two given indexes as JSON. The files only listed
+# in the second index are added, the ones only listed in the first index are removed and the ones
+# with a different type, mode, size, content or link target are modified:
+#   {
+#     "added": [{"path": "new.txt", "type": "file", ...}],
+#     "removed": [{"path": "old.txt", "type": "file", ...}],
+#     "modified": [{"path": "main.go", "from": {"mode": "0644", ...}, "to": {"mode": "0755", ...}}]
+#   }
+compare_indexes() {
+    jq --null-input --slurpfile from "$1" --slurpfile to "$2" '
+        def by_path: map({key: .path, value: .}) | from_entries;
+
+        ($from[0].files | by_path) as $old
+        | ($to[0].files | by_path) as $new
+        | {
+            added: [$to[0].files[] | select($old[.path] == null)],
+            removed: [$from[0].files[] | select($new[.path] == null)],
+            modified: [
+                $from[0].files[]
+                | select($new[.path] != null and $new[.path] != .)
+                | {path, from: ., to: $new[.path]}
+            ]
+        }'
+}
+
+# Prints the differences, as printed by compare_indexes, read from the standard input, one file per
+# line, e.g.:
+#   modified: src/main.go (mode 0644 -> 0755, size 42 -> 43, content)
+print_changes() {
+    jq --raw-output '
+        def change($field; $name):
+            if .from[$field] != .to[$field] then
+                "\($name) \(.from[$field] // "-") -> \(.to[$field] // "-")"
+            else
+                empty
+            end;
+
+        (.added[] | "  added:    \(.path)"),
+        (.removed[] | "  removed:  \(.path)"),
+        (.modified[] | "  modified: \(.path) (\([
+            change("type"; "type"),
+            change("mode"; "mode"),
+            change("size"; "size"),
+            if .from.type == "file" and .to.type == "file" and .from.sha256 != .to.sha256 then "content" else empty end,
+            change("target"; "target")
+        ] | join(", ")))")'
+}
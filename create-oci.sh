@@ -1,8 +1,37 @@
 #!/bin/bash
-# Creates specified trusted artifacts in an OCI repository
+# Creates specified trusted artifacts in an OCI repository or in a directory
 #
 # The --store parameter is an image reference used to specify the repository, e.g.
-# registry.local/org/repo. If the image reference contains a tag, it is ignored.
+# registry.local/org/repo. A tag in the image reference, e.g. registry.local/org/repo:build, is not
+# pushed as is: the store tag strategy and the {tag} placeholder of --tag-template include it in the
+# tag of the pushed manifest, see below.
+#
+# When the --store parameter starts with "file:", e.g. file:/workspace/artifacts, the artifacts are
+# stored in that directory instead, named by their digest: /workspace/artifacts/sha256/<digest>.
+# The directory can be on a volume shared between Tasks, e.g. a PVC backed workspace. The artifact
+# URIs written to the results then start with "file:", e.g. file:/workspace/artifacts@sha256:abcd...
+#
+# When the --store parameter starts with "oci-layout:", e.g. oci-layout:/workspace/layout, the
+# artifacts are written to the OCI image layout in that directory, created if needed, the same way
+# they would be pushed to a repository. The artifact URIs then start with "oci-layout:". The layout
+# can be copied to a registry later on, e.g. using oras cp, without changing any digests.
+#
+# The --tag-strategy parameter controls how the pushed manifest is tagged, so that runs sharing the
+# same repository never overwrite each other's tags:
+#   * store (default)  - tagged with the tag given in the --store parameter, or trusted-artifacts
+#                        when there is none, followed by the short digest of the manifest
+#   * digest           - the manifest is pushed by its digest only, without a tag. Registries that
+#                        garbage collect untagged manifests can remove it at any time
+#   * taskrun          - tagged with the TaskRun name, taken from the TASKRUN_NAME environment
+#                        variable, followed by the short digest of the manifest
+#   * pipelinerun      - tagged with the PipelineRun name, taken from the PIPELINERUN_NAME
+#                        environment variable, followed by the short digest of the manifest
+#   * template         - tagged using the template given by the --tag-template parameter, in which
+#                        {tag}, {taskrun}, {pipelinerun} and {digest} are replaced with the tag
+#                        given in the --store parameter, the TaskRun name, the PipelineRun name and
+#                        the short digest of the manifest. Providing the --tag-template parameter
+#                        implies this strategy.
+# When the manifest is tagged, the tag is included in the artifact URI written to the results.
 #
 # The --results parameter is unused. It is left here for compatibility with non-oci support.
 #
@@ -15,13 +44,64 @@
 # contents of the /home/user/src. Information about this artifact will be written to
 # /home/user/artifact.
 #
+# Creating the artifacts is all-or-nothing: the results are written only after all the archives have
+# been pushed and found in the repository. If anything fails, no result is left behind.
+#
+# The --reproducible parameter makes the archive byte-reproducible: entries are sorted by name and
+# ownership and timestamps are normalized, so the same content always results in the same digest
+# regardless of who created it. The timestamp of all entries is taken from the SOURCE_DATE_EPOCH
+# environment variable, defaulting to 0 (1970-01-01T00:00:00Z).
+#
+# The --compression parameter selects how the archives are compressed: gzip (default), zstd or
+# none. The compression is recorded in the media type of the pushed layer, use-oci.sh detects it
+# when restoring the artifact.
+#
+# The --exclude parameter, which can be repeated, excludes the files matching the given pattern
+# from all artifacts. Additional patterns are read from the .trusted-artifacts-ignore file in the
+# root of each artifact's source directory. Both use a subset of the gitignore syntax: blank lines
+# and lines starting with # are ignored, patterns containing a slash are matched relative to the
+# root of the source directory, other patterns match at any depth. Negated patterns (!) are not
+# supported. The applied patterns are recorded in the annotations of the artifact's layer, and in
+# the annotations of the manifest under a key suffixed with the artifact name.
+#
+# Archives already present in the repository, e.g. pushed by a previous run with the same content,
+# are not uploaded again. The manifest referencing them is pushed regardless.
+#
+# The --sign-key parameter names a PEM encoded, unencrypted, ECDSA private key used to sign the
+# pushed manifest. Keys generated by cosign generate-key-pair are encrypted and can't be used. The
+# signature is attached to the manifest as a referrer in the format used by cosign, so it can be
+# verified by use-oci.sh or by cosign using the matching public key. Signing requires a tag strategy
+# other than digest, the tag is used to find the signed manifest.
+#
+# An in-toto statement with SLSA provenance is attached to the pushed manifest for each artifact, as
+# a referrer, unless the --no-provenance parameter is given. Artifacts stored in a directory have no
+# manifest to attach it to, so they have no provenance, and passing the --provenance parameter is
+# an error then. The statement lists the artifact as its subject and records the source path, the
+# applied exclusions, the trusted artifacts used as inputs and the Tekton context. The inputs are
+# given by the --input parameter, which can be repeated, and are also read from the file named by
+# the TRUSTED_ARTIFACTS_INPUTS environment variable, where use-oci.sh records the artifacts it
+# restored. The Tekton context is taken from the TASKRUN_NAME, PIPELINERUN_NAME and NAMESPACE
+# environment variables. When IMAGE_EXPIRES_AFTER is set, the provenance and the signature expire
+# along with the manifest they are attached to.
+#
+# An index of the files in each archive is stored alongside the artifact: the path, type and mode of
+# every file, with the size and sha256 digest of regular files and the target of symbolic links, see
+# index-oci.sh. The index is pushed as a layer of the manifest following the artifact's layer,
+# annotated with the digest of the artifact, or stored as <directory>/index/<digest>.json when
+# storing the artifacts in a directory.
+#
+# The --jobs parameter sets how many artifacts are archived, and uploaded, at the same time, one at
+# a time by default. If any of them fails, the remaining work is cancelled and all the errors are
+# reported.
+#
 set -o errexit
 set -o nounset
 set -o pipefail
 
-# using `-n` ensures gzip does not add a modification time to the output. This
-# helps in ensuring the archive digest is the same for the same content.
-tar_opts=(--create --use-compress-program='gzip -n' --file)
+# recorded in the provenance of the artifacts
+started="$(date --utc +%Y-%m-%dT%H:%M:%SZ)"
+
+tar_opts=(--create)
 if [[ -n "${DEBUG:-}" ]]; then
   tar_opts=(--verbose "${tar_opts[@]}")
   set -o xtrace
@@ -30,6 +110,16 @@ fi
 # contains {result path}={artifact source path} pairs
 artifact_pairs=()
 
+reproducible=""
+compression=gzip
+excludes=()
+tag_strategy=store
+tag_template=""
+sign_key=""
+# attached by default when the store supports referrers, 1 when requested by --provenance
+provenance=default
+inputs=()
+
 while [[ $# -gt 0 ]]; do
     case $1 in
         --store)
@@ -37,6 +127,54 @@ while [[ $# -gt 0 ]]; do
         shift
         shift
         ;;
+        --reproducible)
+        reproducible=1
+        shift
+        ;;
+        --compression)
+        compression="$2"
+        shift
+        shift
+        ;;
+        --exclude)
+        excludes+=("$2")
+        shift
+        shift
+        ;;
+        --tag-strategy)
+        tag_strategy="$2"
+        shift
+        shift
+        ;;
+        --tag-template)
+        tag_strategy=template
+        tag_template="$2"
+        shift
+        shift
+        ;;
+        --jobs)
+        jobs="$2"
+        shift
+        shift
+        ;;
+        --sign-key)
+        sign_key="$2"
+        shift
+        shift
+        ;;
+        --provenance)
+        provenance=1
+        shift
+        ;;
+        --no-provenance)
+        provenance=""
+        shift
+        ;;
+        --input)
+        inputs+=("$2")
+        shift
+        shift
+        ;;
         -*)
         echo "Unknown option $1"
         exit 1
@@ -49,26 +187,224 @@ while [[ $# -gt 0 ]]; do
 done
 
 if [[ -z "${store:-}" ]]; then
-    echo "--store cannot be empty when creating OCI artifacts"
+    echo "--store cannot be empty when creating artifacts"
     exit 1
 fi
 
+if [[ ! "${jobs:-1}" =~ ^[1-9][0-9]*$ ]]; then
+    echo "--jobs must be a positive number, got: ${jobs}"
+    exit 1
+fi
+
+if [[ "${store}" == file:* ]]; then
+    if [[ "${provenance}" == 1 ]]; then
+        echo "--provenance is not supported when storing artifacts in a directory"
+        exit 1
+    fi
+    provenance=""
+fi
+
+if [[ -n "${sign_key}" ]]; then
+    if [[ "${store}" == file:* ]]; then
+        echo "--sign-key is not supported when storing artifacts in a directory"
+        exit 1
+    fi
+    if [[ "${tag_strategy}" == digest ]]; then
+        echo "--sign-key requires a tag strategy other than digest, the tag is needed to find the signed manifest"
+        exit 1
+    fi
+    if [[ ! -r "${sign_key}" ]]; then
+        echo "Unable to read the signing key: ${sign_key}"
+        exit 1
+    fi
+    # encrypted keys, e.g. the ones created by cosign generate-key-pair, can't be loaded without a
+    # password
+    if ! openssl pkey -in "${sign_key}" -passin pass: -noout 2> /dev/null; then
+        echo "The signing key is not an unencrypted PEM encoded private key: ${sign_key}"
+        exit 1
+    fi
+fi
+
+# runs the archiving and uploading of the artifacts concurrently
+source jobs.sh
+
+# indexes the files in the archives and converts the exclusions to tar options
+source artifacts.sh
+
+case "${tag_strategy}" in
+    store)
+        tag_template='{tag}-{digest}'
+        ;;
+    digest)
+        ;;
+    taskrun)
+        if [[ -z "${TASKRUN_NAME:-}" ]]; then
+            echo "TASKRUN_NAME must be set when using the taskrun tag strategy"
+            exit 1
+        fi
+        tag_template='{taskrun}-{digest}'
+        ;;
+    pipelinerun)
+        if [[ -z "${PIPELINERUN_NAME:-}" ]]; then
+            echo "PIPELINERUN_NAME must be set when using the pipelinerun tag strategy"
+            exit 1
+        fi
+        tag_template='{pipelinerun}-{digest}'
+        ;;
+    template)
+        if [[ -z "${tag_template}" ]]; then
+            echo "--tag-template cannot be empty when using the template tag strategy"
+            exit 1
+        fi
+        ;;
+    *)
+        echo "Unsupported tag strategy: ${tag_strategy}, expected one of: store, digest, taskrun, pipelinerun, template"
+        exit 1
+        ;;
+esac
+
+case "${compression}" in
+    gzip)
+        # using `-n` ensures gzip does not add a modification time to the output. This
+        # helps in ensuring the archive digest is the same for the same content.
+        tar_opts+=(--use-compress-program='gzip -n')
+        media_type=application/vnd.oci.image.layer.v1.tar+gzip
+        ;;
+    zstd)
+        # zstd output does not depend on the number of threads used
+        tar_opts+=(--use-compress-program='zstd --quiet --threads=0')
+        media_type=application/vnd.oci.image.layer.v1.tar+zstd
+        ;;
+    none)
+        media_type=application/vnd.oci.image.layer.v1.tar
+        ;;
+    *)
+        echo "Unsupported compression: ${compression}, expected one of: gzip, zstd, none"
+        exit 1
+        ;;
+esac
+
+if [[ -n "${reproducible}" ]]; then
+    source_date_epoch="${SOURCE_DATE_EPOCH:-0}"
+    if [[ ! "${source_date_epoch}" =~ ^[0-9]+$ ]]; then
+        echo "SOURCE_DATE_EPOCH must be a number of seconds since the epoch, got: ${source_date_epoch}"
+        exit 1
+    fi
+
+    # the order of entries returned by the filesystem, the owner of the files and their timestamps
+    # all end up in the archive, normalize them so only the content and the file modes remain
+    tar_opts=(
+        --sort=name
+        --owner=0
+        --group=0
+        --numeric-owner
+        --mtime="@${source_date_epoch}"
+        --format=gnu
+        --no-acls
+        --no-xattrs
+        --no-selinux
+        "${tar_opts[@]}"
+    )
+fi
+
+# Checks if the blob with the given digest is already present in the repository
+blob_exists() {
+    oras blob fetch "${oras_opts[@]}" "${target_opts[@]}" --descriptor \
+        "${repo}@$1" > /dev/null 2>&1
+}
+
+# Prints the tag for the manifest with the given digest by expanding the tag template. Characters
+# not allowed in tags are replaced by a dash.
+manifest_tag() {
+    local tag="${tag_template}"
+    tag="${tag//\{tag\}/${store_tag}}"
+    tag="${tag//\{taskrun\}/${TASKRUN_NAME:-}}"
+    tag="${tag//\{pipelinerun\}/${PIPELINERUN_NAME:-}}"
+    tag="${tag//\{digest\}/${1:7:12}}"
+    tag="${tag//[^a-zA-Z0-9_.-]/-}"
+    # tags must start with a letter, a digit or an underscore and are at most 128 characters long
+    if [[ "${tag}" == [.-]* ]]; then
+        tag="_${tag}"
+    fi
+    echo -n "${tag:0:128}"
+}
+
+# Uploads the given file as a blob with the given digest to the repository
+push_blob() {
+    retry oras blob push "${oras_opts[@]}" "${target_opts[@]}" "${repo}@$2" "$1" > /dev/null
+}
+
 archive_dir="$(mktemp -d)"
 
 artifacts=()
 
-repo="$(echo -n "$store" | sed 's_/\(.*\):\(.*\)_/\1_g')"
+# results are written only once all artifacts are in the repository, until then the result paths
+# and the digests of the artifacts are kept here
+result_paths=()
+digests=()
+
+# the source paths of the artifacts
+sources=()
+
+# the indexes of the files in the artifacts, and their digests
+indexes=()
+index_digests=()
+
+# result files that have been (possibly partially) written so far
+written_results=()
+
+# annotations of the pushed manifest and layers, keyed by the artifact name or "$manifest"
+annotations='{}'
+
+store_type=oci
+# the tag given in the --store parameter, used by the store tag strategy
+store_tag=trusted-artifacts
+case "${store}" in
+    file:*)
+        store_type=file
+        store_dir="$(realpath --canonicalize-missing "${store#file:}")"
+        ;;
+    oci-layout:*)
+        store_type=oci-layout
+        repo="$(realpath --canonicalize-missing "${store#oci-layout:}")"
+        ;;
+    *)
+        repo="$(echo -n "$store" | sed 's_/\(.*\):\(.*\)_/\1_g')"
+        if [[ "${store#*/}" == *:* ]]; then
+            store_tag="${store##*:}"
+        fi
+        ;;
+esac
 
 tmp_workdir=$(mktemp -d --tmpdir create-oci.sh.XXXXXX)
-trap 'rm -rf $tmp_workdir' EXIT
 
-for artifact_pair in "${artifact_pairs[@]}"; do
+cleanup() {
+    local status=$?
+    if [[ ${status} -ne 0 ]]; then
+        if [[ ${#written_results[@]} -gt 0 ]]; then
+            rm -f "${written_results[@]}"
+        fi
+        echo "ERROR: failed to create the artifacts, no results have been written" >&2
+    fi
+    rm -rf "${tmp_workdir}"
+}
+trap cleanup EXIT
+
+# Creates the archive of the artifact pair with the given index. The name, result path and digest of
+# the artifact, and the applied exclusions, are recorded in ${tmp_workdir}/artifact-<index>, and the
+# index of the files in the archive in ${tmp_workdir}/artifact-<index>.index.json. Nothing is
+# recorded for skipped artifacts.
+prepare_artifact() {
+    local artifact_pair="${artifact_pairs[$1]}"
+    local record="${tmp_workdir}/artifact-$1"
+    local result_path path artifact_name archive pattern applied_excludes exclude_opts sha256sum_output digest
+
     result_path="${artifact_pair/=*}"
     path="${artifact_pair/*=}"
 
     if [ -f "${path}/.skip-trusted-artifacts" ]; then
       echo WARN: found skip file in "${path}"
-      continue
+      return
     fi
 
     artifact_name="$(basename "${result_path}")"
@@ -77,40 +413,386 @@ for artifact_pair in "${artifact_pairs[@]}"; do
 
     # log "creating tar archive %s with files from %s" "${archive}" "${path}"
 
+    applied_excludes=("${excludes[@]}")
+    read_ignore_file "${path}" applied_excludes
+
+    exclude_opts=()
+    for pattern in "${applied_excludes[@]}"; do
+        add_exclude "${pattern}"
+    done
+
     if [ ! -r "${path}" ]; then
         # non-existent paths result in empty archives
-        tar "${tar_opts[@]}" "${archive}" --files-from /dev/null
+        tar "${tar_opts[@]}" --file "${archive}" --files-from /dev/null
     elif [ -d "${path}" ]; then
         # archive the whole directory
-        tar "${tar_opts[@]}" "${archive}" --directory="${path}" .
+        tar "${tar_opts[@]}" --file "${archive}" "${exclude_opts[@]}" --directory="${path}" .
     else
         # archive a single file
-        tar "${tar_opts[@]}" "${archive}" --directory="${path%/*}" "${path##*/}"
+        tar "${tar_opts[@]}" --file "${archive}" "${exclude_opts[@]}" --directory="${path%/*}" "${path##*/}"
+    fi
+
+    if [[ ${#applied_excludes[@]} -gt 0 ]]; then
+        printf '%s\n' "${applied_excludes[@]}" > "${record}.excludes"
+        echo "Excluded from ${path}: ${applied_excludes[*]}"
     fi
 
     sha256sum_output="$(sha256sum "${archive}")"
     digest="${sha256sum_output/ */}"
-    echo -n "oci:${repo}@sha256:${digest}" > "${result_path}"
 
-    artifacts+=("${artifact_name}")
+    # the exclusions are recorded in the index, so that the files they match can be told apart from
+    # files added to a restored artifact
+    index_archive "${archive}" "sha256:${digest}" \
+        | jq --args '. + {excludes: $ARGS.positional}' "${applied_excludes[@]}" > "${record}.index.json"
+
+    printf '%s\n' "${artifact_name}" "${result_path}" "${digest}" "${path}" > "${record}"
 
     echo Prepared artifact from "${path} (sha256:${digest})"
+}
+
+# the archives are created concurrently, the results are collected in the order of the artifact
+# pairs afterwards
+run_jobs prepare_artifact artifact_pairs
+
+for i in "${!artifact_pairs[@]}"; do
+    record="${tmp_workdir}/artifact-${i}"
+    if [[ ! -f "${record}" ]]; then
+        # skipped
+        continue
+    fi
+
+    { read -r artifact_name; read -r result_path; read -r digest; read -r path; } < "${record}"
+
+    if [[ -f "${record}.excludes" ]]; then
+        # record the exclusions in the annotations of the artifact's layer, and of the manifest keyed
+        # by the artifact name, as the manifest can hold several artifacts
+        annotations="$(jq --arg name "${artifact_name}" \
+            --arg excludes "$(jq --raw-input --slurp --compact-output 'split("\n")[:-1]' < "${record}.excludes")" \
+            '.[$name]["dev.konflux-ci.trusted-artifacts.excludes"] = $excludes
+            | .["$manifest"]["dev.konflux-ci.trusted-artifacts.excludes." + $name] = $excludes' <<< "${annotations}")"
+    fi
+
+    result_paths+=("${result_path}")
+    digests+=("${digest}")
+    sources+=("${path}")
+    indexes+=("${record}.index.json")
+    sha256sum_output="$(sha256sum "${record}.index.json")"
+    index_digests+=("${sha256sum_output/ */}")
+
+    artifacts+=("${artifact_name}")
 done
 
-if [ ${#artifacts[@]} != 0 ]; then
+# Uploads the archive of the artifact with the given index, and the index of its files, unless they
+# are already present in the repository
+upload_artifact() {
+    local artifact_name="${artifacts[$1]}"
+    local digest="sha256:${digests[$1]}"
+    local index_digest="sha256:${index_digests[$1]}"
+
+    if blob_exists "${digest}"; then
+        echo "Deduplicated artifact ${artifact_name} (${digest}), already present in ${repo}"
+    else
+        push_blob "${archive_dir}/${artifact_name}" "${digest}"
+        echo "Uploaded artifact ${artifact_name} (${digest})"
+    fi
+
+    if ! blob_exists "${index_digest}"; then
+        push_blob "${indexes[$1]}" "${index_digest}"
+    fi
+}
+
+# Attaches the given file, in the temporary working directory, to the manifest with the given digest
+# as a referrer with the given artifact type. The file is the only layer of the referrer, with the
+# given media type and annotations.
+attach_referrer() {
+    local manifest_digest="$1" artifact_type="$2" file="$3" media_type="$4" layer_annotations="$5"
+
+    # oras names the layer after the file, the annotations of the layer are keyed by that name. The
+    # referrer expires along with the manifest it refers to
+    jq --null-input --arg file "${file}" --argjson annotations "${layer_annotations}" \
+        --arg expires "${IMAGE_EXPIRES_AFTER:-}" \
+        '{($file): $annotations}
+        | if $expires != "" then .["$manifest"]["quay.expires-after"] = $expires else . end' \
+        > "${tmp_workdir}/${file}.annotations"
+
+    (
+        cd "${tmp_workdir}"
+        retry oras attach "${oras_opts[@]}" "${target_opts[@]}" \
+            --artifact-type "${artifact_type}" \
+            --annotation-file "${file}.annotations" \
+            "${repo}@${manifest_digest}" "${file}:${media_type}" > /dev/null
+    )
+}
+
+# Signs the manifest with the given digest using the --sign-key and attaches the signature to the
+# manifest as a referrer, in the format cosign uses: the signature of the simple signing payload is
+# stored in the annotations of the payload's layer
+sign_manifest() {
+    local manifest_digest="$1"
+    local signature
+
+    jq --null-input --compact-output --arg ref "${repo}" --arg digest "${manifest_digest}" \
+        '{
+            critical: {
+                identity: {"docker-reference": $ref},
+                image: {"docker-manifest-digest": $digest},
+                type: "cosign container image signature"
+            },
+            optional: null
+        }' > "${tmp_workdir}/payload.json"
+
+    signature="$(openssl dgst -sha256 -sign "${sign_key}" "${tmp_workdir}/payload.json" | base64 --wrap=0)"
+
+    attach_referrer "${manifest_digest}" application/vnd.dev.cosign.artifact.sig.v1+json \
+        payload.json application/vnd.dev.cosign.simplesigning.v1+json \
+        "$(jq --null-input --compact-output --arg signature "${signature}" '{"dev.cosignproject.cosign/signature": $signature}')"
+    echo "Signed manifest ${repo}@${manifest_digest}"
+}
+
+# Attaches an in-toto statement with SLSA provenance to the manifest with the given digest for each
+# of the artifacts. The statement records the source path of the artifact, the applied exclusions,
+# the trusted artifacts used as inputs and the Tekton context.
+attach_provenance() {
+    local manifest_digest="$1"
+    local i statement dependencies finished
+
+    # the input artifacts given by --input and the ones recorded by use-oci.sh
+    dependencies="$(
+        {
+            printf '%s\n' "${inputs[@]}"
+            if [[ -n "${TRUSTED_ARTIFACTS_INPUTS:-}" && -f "${TRUSTED_ARTIFACTS_INPUTS}" ]]; then
+                cat "${TRUSTED_ARTIFACTS_INPUTS}"
+            fi
+        } | jq --raw-input --slurp --compact-output '
+            split("\n") | map(select(. != "")) | unique
+            | map({uri: ., digest: {sha256: (split("@sha256:")[1] // "")}})'
+    )"
+
+    finished="$(date --utc +%Y-%m-%dT%H:%M:%SZ)"
+
+    for i in "${!artifacts[@]}"; do
+        statement="provenance-${i}.json"
+        jq --null-input --compact-output \
+            --arg name "${artifacts[i]}" \
+            --arg digest "${digests[i]}" \
+            --arg source "${sources[i]}" \
+            --arg location "${store_type}:${repo}${tag:+:${tag}}@sha256:${digests[i]}" \
+            --argjson annotations "${annotations}" \
+            --argjson dependencies "${dependencies}" \
+            --arg started "${started}" \
+            --arg finished "${finished}" \
+            --arg taskrun "${TASKRUN_NAME:-}" \
+            --arg pipelinerun "${PIPELINERUN_NAME:-}" \
+            --arg namespace "${NAMESPACE:-}" \
+            '{
+                _type: "https://in-toto.io/Statement/v1",
+                subject: [{name: $name, uri: $location, digest: {sha256: $digest}}],
+                predicateType: "https://slsa.dev/provenance/v1",
+                predicate: {
+                    buildDefinition: {
+                        buildType: "https://konflux-ci.dev/trusted-artifacts/create/v1",
+                        externalParameters: {
+                            source: $source,
+                            excludes: ($annotations[$name]["dev.konflux-ci.trusted-artifacts.excludes"] // "[]" | fromjson)
+                        },
+                        internalParameters: {
+                            tekton: {
+                                taskRun: $taskrun,
+                                pipelineRun: $pipelinerun,
+                                namespace: $namespace
+                            }
+                        },
+                        resolvedDependencies: $dependencies
+                    },
+                    runDetails: {
+                        builder: {id: "https://konflux-ci.dev/trusted-artifacts"},
+                        metadata: {
+                            invocationId: $taskrun,
+                            startedOn: $started,
+                            finishedOn: $finished
+                        }
+                    }
+                }
+            }' > "${tmp_workdir}/${statement}"
+
+        attach_referrer "${manifest_digest}" application/vnd.in-toto+json \
+            "${statement}" application/vnd.in-toto+json \
+            "$(jq --null-input --compact-output --arg name "${artifacts[i]}" '{"org.opencontainers.image.title": $name}')"
+        echo "Attached provenance of artifact ${artifacts[i]} to ${repo}@${manifest_digest}"
+    done
+}
+
+# Pushes the artifacts to the OCI repository, or the OCI image layout, and sets the location of the
+# artifacts
+push_to_registry() {
     # read in any oras options
     source oras_opts.sh
 
-    if [[ -n  "${IMAGE_EXPIRES_AFTER:-}" ]]; then
-        oras_opts+=("--annotation=quay.expires-after=${IMAGE_EXPIRES_AFTER}")
+    if [[ -n "${IMAGE_EXPIRES_AFTER:-}" ]]; then
+        annotations="$(jq --arg expires "${IMAGE_EXPIRES_AFTER}" \
+            '.["$manifest"]["quay.expires-after"] = $expires' <<< "${annotations}")"
+    fi
+
+    # options selecting where oras reads from and writes to
+    target_opts=(--oci-layout)
+    if [[ "${store_type}" == oci ]]; then
+        authfile=$(mktemp --tmpdir="$tmp_workdir" "auth-XXXXXX.json")
+        select-oci-auth.sh "$repo" > "$authfile"
+        target_opts=(--registry-config "$authfile")
+        registry_tls_opts "${repo%%/*}" "$tmp_workdir" target_opts
+    fi
+
+    # the manifest is built here rather than by oras push, so that the archives already present in
+    # the repository don't need to be uploaded again
+    run_jobs upload_artifact artifacts
+
+    layers='[]'
+    for i in "${!artifacts[@]}"; do
+        artifact_name="${artifacts[i]}"
+        archive="${archive_dir}/${artifact_name}"
+        digest="sha256:${digests[i]}"
+
+        # the media type tells the consumers how the archive is compressed. The index of the files in
+        # the archive follows it, annotated with the digest of the archive
+        layers="$(jq --arg name "${artifact_name}" --arg digest "${digest}" \
+            --arg mediaType "${media_type}" --argjson size "$(stat --format=%s "${archive}")" \
+            --arg index_digest "sha256:${index_digests[i]}" \
+            --argjson index_size "$(stat --format=%s "${indexes[i]}")" \
+            --argjson annotations "${annotations}" \
+            '. + [{
+                mediaType: $mediaType,
+                digest: $digest,
+                size: $size,
+                annotations: ({"org.opencontainers.image.title": $name} + ($annotations[$name] // {}))
+            }, {
+                mediaType: "application/vnd.konflux-ci.trusted-artifacts.index.v1+json",
+                digest: $index_digest,
+                size: $index_size,
+                annotations: {
+                    "org.opencontainers.image.title": ($name + ".index.json"),
+                    "dev.konflux-ci.trusted-artifacts.index-of": $digest
+                }
+            }]' <<< "${layers}")"
+    done
+
+    # the empty JSON object used as the config, same as oras push uses
+    config="${tmp_workdir}/config.json"
+    echo -n '{}' > "${config}"
+    config_digest="sha256:$(sha256sum "${config}" | cut -d' ' -f1)"
+    if ! blob_exists "${config_digest}"; then
+        push_blob "${config}" "${config_digest}"
+    fi
+
+    created="$(date --utc +%Y-%m-%dT%H:%M:%SZ)"
+    if [[ -n "${reproducible}" ]]; then
+        created="$(date --utc --date="@${source_date_epoch}" +%Y-%m-%dT%H:%M:%SZ)"
+    fi
+
+    manifest="${tmp_workdir}/manifest.json"
+    jq --null-input --compact-output --argjson layers "${layers}" --argjson annotations "${annotations}" \
+        --arg created "${created}" \
+        '{
+            schemaVersion: 2,
+            mediaType: "application/vnd.oci.image.manifest.v1+json",
+            artifactType: "application/vnd.unknown.artifact.v1",
+            config: {
+                mediaType: "application/vnd.oci.empty.v1+json",
+                digest: "sha256:44136fa355b3678a1146ad16f7e8649e94fb4fc21fe77e8310c060f61caaff8a",
+                size: 2,
+                data: "e30="
+            },
+            layers: $layers,
+            annotations: ({"org.opencontainers.image.created": $created} + ($annotations["$manifest"] // {}))
+        }' > "${manifest}"
+
+    manifest_digest="sha256:$(sha256sum "${manifest}" | cut -d' ' -f1)"
+    tag=""
+    target="${repo}@${manifest_digest}"
+    if [[ -n "${tag_template}" ]]; then
+        tag="$(manifest_tag "${manifest_digest}")"
+        target="${repo}:${tag}"
+    fi
+
+    retry oras manifest push "${oras_opts[@]}" "${target_opts[@]}" \
+        --media-type application/vnd.oci.image.manifest.v1+json "${target}" "${manifest}"
+    echo "Pushed manifest ${repo}${tag:+:${tag}}@${manifest_digest}"
+
+    # make sure every blob made it to the repository before any result refers to it
+    for digest in "${digests[@]}"; do
+        if ! retry oras blob fetch "${oras_opts[@]}" "${target_opts[@]}" --descriptor \
+            "${repo}@sha256:${digest}" > /dev/null; then
+            echo "ERROR: artifact sha256:${digest} not found in ${repo} after pushing"
+            exit 1
+        fi
+    done
+
+    if [[ -n "${sign_key}" ]]; then
+        sign_manifest "${manifest_digest}"
+    fi
+
+    if [[ -n "${provenance}" ]]; then
+        attach_provenance "${manifest_digest}"
     fi
 
-    authfile=$(mktemp --tmpdir="$tmp_workdir" "auth-XXXXXX.json")
-    select-oci-auth.sh "$repo" > "$authfile"
+    location="${store_type}:${repo}${tag:+:${tag}}"
+}
+
+# Copies the given file to the given path in the store, under a temporary name first so a partially
+# written file is never visible under its name, even to Tasks running concurrently. The temporary name
+# is unique, Tasks on other nodes sharing the store included.
+store_file() {
+    local file="$1" path="$2"
+    local tmp
+
+    tmp="$(mktemp "${path%/*}/.tmp.XXXXXX")" || return 1
+    # mktemp creates the file readable by its owner only
+    if ! cp "${file}" "${tmp}" || ! chmod 0644 "${tmp}" || ! mv --force "${tmp}" "${path}"; then
+        rm -f "${tmp}"
+        return 1
+    fi
+}
+
+# Stores the artifacts in the directory, named by their digest, and the indexes of their files
+# under index/<digest>.json, and sets the location of the artifacts
+store_in_directory() {
+    mkdir -p "${store_dir}/sha256" "${store_dir}/index"
+
+    for i in "${!artifacts[@]}"; do
+        artifact_name="${artifacts[i]}"
+        archive="${archive_dir}/${artifact_name}"
+        stored="${store_dir}/sha256/${digests[i]}"
+
+        store_file "${indexes[i]}" "${store_dir}/index/${digests[i]}.json"
+
+        if [[ -f "${stored}" ]] && echo "${digests[i]}  ${stored}" | sha256sum --check --status; then
+            echo "Deduplicated artifact ${artifact_name} (sha256:${digests[i]}), already present in ${store_dir}"
+            continue
+        fi
+
+        store_file "${archive}" "${stored}"
+
+        if ! echo "${digests[i]}  ${stored}" | sha256sum --check --status; then
+            echo "ERROR: artifact sha256:${digests[i]} stored in ${store_dir} does not match its digest"
+            exit 1
+        fi
+
+        echo "Stored artifact ${artifact_name} (sha256:${digests[i]})"
+    done
+
+    location="file:${store_dir}"
+}
+
+if [ ${#artifacts[@]} != 0 ]; then
+    if [[ "${store_type}" == file ]]; then
+        store_in_directory
+    else
+        push_to_registry
+    fi
 
-    pushd "${archive_dir}" > /dev/null
-    retry oras push "${oras_opts[@]}" --registry-config "$authfile" "${store}" "${artifacts[@]}"
-    popd > /dev/null
+    for i in "${!result_paths[@]}"; do
+        written_results+=("${result_paths[i]}")
+        echo -n "${location}@sha256:${digests[i]}" > "${result_paths[i]}"
+    done
 
     echo 'Artifacts created'
 fi
@@ -0,0 +1,112 @@
+#!/bin/bash
+# Shows the differences between the files in two trusted artifacts
+#
+# The positional parameters are the URIs of the two artifacts, as written to the results by
+# create-oci.sh, e.g. the source artifacts of two PipelineRuns. The files only in the second
+# artifact are reported as added, the files only in the first one as removed, and the files with a
+# different type, mode, size, content or symbolic link target as modified, with the changes of the
+# type, mode, size and link target, e.g.:
+#   added:    go.sum
+#   modified: main.go (mode 0644 -> 0755, size 42 -> 43, content)
+#
+# The archives of both artifacts are fetched, verified against their digests and indexed, see
+# index-oci.sh, so the result depends on nothing but the digests in the URIs. The indexes stored
+# alongside the artifacts are not used, they are found via the tag in the URI, or in the store
+# directory, which can change after the artifact was created. Artifacts are fetched using the same
+# credentials as use-oci.sh, selected by select-oci-auth.sh.
+#
+# The --json parameter prints the differences as a JSON object instead:
+#   {
+#     "from": "oci:registry/org/repo@sha256:123...",
+#     "to": "oci:registry/org/repo@sha256:456...",
+#     "added": [{"path": "go.sum", "type": "file", "mode": "0644", "size": 42, "sha256": "..."}],
+#     "removed": [],
+#     "modified": [{"path": "main.go", "from": {...}, "to": {...}}]
+#   }
+#
+# The script succeeds whether or not the artifacts differ, it fails only if either of them cannot
+# be indexed.
+#
+set -o errexit
+set -o nounset
+set -o pipefail
+
+if [[ -n "${DEBUG:-}" ]]; then
+  set -o xtrace
+fi
+
+uris=()
+json=""
+
+while [[ $# -gt 0 ]]; do
+  case $1 in
+    --json)
+      json=1
+      shift
+      ;;
+    -*)
+      echo "Unknown option $1" >&2
+      exit 1
+      ;;
+    *)
+      uris+=("$1")
+      shift
+      ;;
+  esac
+done
+
+if [[ ${#uris[@]} -ne 2 ]]; then
+    echo "Usage: diff [--json] <artifact URI> <artifact URI>" >&2
+    exit 1
+fi
+
+for uri in "${uris[@]}"; do
+    case "${uri/:*}" in
+        oci|oci-layout|file)
+            ;;
+        *)
+            echo "Unsupported archive type: ${uri/:*}" >&2
+            exit 1
+            ;;
+    esac
+
+    if [[ "${uri##*@}" != sha256:* ]]; then
+        echo "Unsupported artifact digest: ${uri##*@}, expected a sha256 digest" >&2
+        exit 1
+    fi
+done
+
+# read in any oras options
+source oras_opts.sh
+
+# fetches, indexes and compares the artifacts
+source artifacts.sh
+
+tmp_workdir=$(mktemp -d --tmpdir diff-oci.sh.XXXXXX)
+trap 'rm -rf "${tmp_workdir}"' EXIT
+
+for i in "${!uris[@]}"; do
+    work="$(mktemp -d --tmpdir="${tmp_workdir}" artifact.XXXXXX)"
+    target_opts=()
+    artifact_target_opts "${uris[i]}" "${work}" target_opts
+
+    if ! index_artifact_archive "${uris[i]}" "${tmp_workdir}/index-${i}.json" "${work}" "${target_opts[@]}"; then
+        echo "ERROR: unable to index artifact ${uris[i]#*:}" >&2
+        exit 1
+    fi
+done
+
+compare_indexes "${tmp_workdir}/index-0.json" "${tmp_workdir}/index-1.json" > "${tmp_workdir}/changes.json"
+
+if [[ -n "${json}" ]]; then
+    jq --arg from "${uris[0]}" --arg to "${uris[1]}" '{from: $from, to: $to} + .' "${tmp_workdir}/changes.json"
+    exit 0
+fi
+
+echo "--- ${uris[0]}"
+echo "+++ ${uris[1]}"
+if jq --exit-status 'all(.[]; length == 0)' "${tmp_workdir}/changes.json" > /dev/null; then
+    echo "  (no differences)"
+else
+    print_changes < "${tmp_workdir}/changes.json"
+fi
@@ -2,35 +2,68 @@
 # Determines the storage location and delegates to the implementation of the
 # operation.
 #
-# Two operations are supported currently:
+# The following operations are supported currently:
 #  * `create`` - to create a trusted artifact, will put a directory or files into a
 #    trusted artifact with a given name.
 #  * `use``    - to use a trusted artifact, will restore content of a trusted
 #    artifact identified via its name to a provided directory
+#  * `index``  - to print the index of the files in a trusted artifact
+#  * `inspect`` - to show where a trusted artifact is stored, its annotations,
+#    signatures and provenance, and optionally its files, without restoring it
+#  * `verify`` - to check that a directory still matches the trusted artifact it
+#    was restored from
+#  * `diff``   - to show the files that differ between two trusted artifacts
 #
 # Invoking the `create` operation will store the specified directory or file in
 # a trusted archive and will generate the uri of the artifact with the digest.
-# For example `create source=/workspace/source` will generate a result of
-# `file:source@sha256:abcd...`.
+# For example `create --store file:/workspace/artifacts source=/workspace/source`
+# will generate a result of `file:/workspace/artifacts@sha256:abcd...`.
 # The result of the `create` operation needs to be provided to the `use`
 # operation.
 #
 # The storage location of trusted artifacts can be specified with the `--store`
-# parameter.
+# parameter, either an OCI repository, e.g. `quay.io/org/repo`, a directory
+# prefixed with `file:`, e.g. `file:/workspace/artifacts`, or an OCI image
+# layout directory prefixed with `oci-layout:`, e.g.
+# `oci-layout:/workspace/layout`.
 #
 # Examples:
 #     # to create the trusted artifact named "source" from the content of
 #     # "/workspace/source/checkout"
-#     create source=/workspace/source/checkout
+#     create --store file:/workspace/artifacts source=/workspace/source/checkout
 #
 #     # to restore the trusted artifact named "source" to the directory
 #     #"/workspace/build/source"
-#     use file:source@sha256:abc...=/workspace/build/source
+#     use file:/workspace/artifacts@sha256:abc...=/workspace/build/source
+#
+#     # to print the index of the files in the trusted artifact
+#     index file:/workspace/artifacts@sha256:abc...
+#
+#     # to show the trusted artifact and the files in it
+#     inspect --files file:/workspace/artifacts@sha256:abc...
+#
+#     # to check that nothing changed the restored trusted artifact since
+#     verify file:/workspace/artifacts@sha256:abc...=/workspace/build/source
+#
+#     # to show the files that differ between two trusted artifacts
+#     diff file:/workspace/artifacts@sha256:abc... file:/workspace/artifacts@sha256:def...
 #
 set -o errexit
 set -o nounset
 set -o pipefail
 
+# With DEBUG set, the trace and the debug output of oras, both written to the standard error, can
+# include the credentials sent to the registry, so the entrypoint runs again with its standard error
+# passed through redact.sh. The standard output is left untouched, it carries the output of the
+# operations, e.g. the JSON printed by index, inspect --json and diff --json. With pipefail, the exit
+# status is that of the entrypoint, redact.sh does not fail.
+if [[ -n "${DEBUG:-}" && -z "${TRUSTED_ARTIFACTS_REDACTED:-}" ]]; then
+    export TRUSTED_ARTIFACTS_REDACTED=1
+    status=0
+    { "$0" "$@" 2>&1 1>&3 3>&- | redact.sh >&2; } 3>&1 || status=$?
+    exit "${status}"
+fi
+
 log() {
     :
 }
@@ -49,7 +82,7 @@ fi
 export -f log
 
 if [[ $# -eq 0 ]]; then
-    echo "Usage: $0 <create|use> [args...]"
+    echo "Usage: $0 <create|use|index|inspect|verify|diff> [args...]"
     exit 1
 fi
 
@@ -78,6 +111,18 @@ case "${op}" in
     "use")
         /usr/bin/time -v /usr/local/bin/use-archive "${cmd[@]}"
         ;;
+    "index")
+        /usr/local/bin/index-archive "${cmd[@]}"
+        ;;
+    "inspect")
+        /usr/local/bin/inspect-archive "${cmd[@]}"
+        ;;
+    "verify")
+        /usr/bin/time -v /usr/local/bin/verify-archive "${cmd[@]}"
+        ;;
+    "diff")
+        /usr/local/bin/diff-archive "${cmd[@]}"
+        ;;
     *)
         echo "Unsupported operation: ${op}"
         exit 1
@@ -0,0 +1,100 @@
+#!/bin/bash
+# Prints the index of the files in a trusted artifact
+#
+# The positional parameter is the URI of the artifact, as written to the results by create-oci.sh,
+# e.g. oci:registry/org/repo:tag@sha256:123. The index lists every file in the artifact with its
+# path, type and octal mode, regular files with their size and sha256 digest and symbolic links with
+# their target, in JSON, sorted by path:
+#   {
+#     "artifact": "sha256:123...",
+#     "files": [
+#       {"path": "src", "type": "directory", "mode": "0755"},
+#       {"path": "src/main.go", "type": "file", "mode": "0644", "size": 42, "sha256": "abc..."}
+#     ]
+#   }
+# The indexes stored by create-oci.sh also list the exclusions applied when creating the artifact,
+# as "excludes".
+#
+# The index stored alongside the artifact by create-oci.sh is used when there is one. Otherwise, e.g.
+# for untagged artifacts or artifacts created before the indexes were stored, the archive is fetched,
+# verified against its digest and indexed. The stored index is found via the tag in the URI, not the
+# digest, so it is meant for listing the files, diff-oci.sh and verify-oci.sh don't rely on it.
+#
+# The --output parameter names the file the index is written to, by default it is printed to the
+# standard output. Any other messages are printed to the standard error.
+#
+set -o errexit
+set -o nounset
+set -o pipefail
+
+if [[ -n "${DEBUG:-}" ]]; then
+  set -o xtrace
+fi
+
+uri=""
+output=""
+
+while [[ $# -gt 0 ]]; do
+  case $1 in
+    --output)
+      output="$2"
+      shift
+      shift
+      ;;
+    -*)
+      echo "Unknown option $1" >&2
+      exit 1
+      ;;
+    *)
+      if [[ -n "${uri}" ]]; then
+        echo "Only one artifact can be indexed at a time, got: ${uri} and $1" >&2
+        exit 1
+      fi
+      uri="$1"
+      shift
+      ;;
+  esac
+done
+
+if [[ -z "${uri}" ]]; then
+    echo "Usage: index [--output <file>] <artifact URI>" >&2
+    exit 1
+fi
+
+case "${uri/:*}" in
+    oci|oci-layout|file)
+        ;;
+    *)
+        echo "Unsupported archive type: ${uri/:*}" >&2
+        exit 1
+        ;;
+esac
+
+if [[ "${uri##*@}" != sha256:* ]]; then
+    echo "Unsupported artifact digest: ${uri##*@}, expected a sha256 digest" >&2
+    exit 1
+fi
+
+# read in any oras options
+source oras_opts.sh
+
+# fetches and indexes the artifact
+source artifacts.sh
+
+tmp_workdir=$(mktemp -d --tmpdir index-oci.sh.XXXXXX)
+trap 'rm -rf "${tmp_workdir}"' EXIT
+
+target_opts=()
+artifact_target_opts "${uri}" "${tmp_workdir}" target_opts
+
+index="${tmp_workdir}/index.json"
+if ! artifact_index "${uri}" "${index}" "${tmp_workdir}" "${target_opts[@]}"; then
+    echo "ERROR: unable to index artifact ${uri#*:}" >&2
+    exit 1
+fi
+
+if [[ -n "${output}" ]]; then
+    cp "${index}" "${output}"
+else
+    jq . "${index}"
+fi
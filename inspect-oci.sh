@@ -0,0 +1,228 @@
+#!/bin/bash
+# Shows what a trusted artifact contains, without restoring it
+#
+# The positional parameter is the URI of the artifact, as written to the results by create-oci.sh,
+# e.g. oci:registry/org/repo:tag@sha256:123. The following is shown:
+#   * the repository, OCI image layout or directory the artifact is stored in, and its tag
+#   * the digest, size and media type of the archive, and the annotations of its layer
+#   * the digest and the annotations of the manifest containing the archive
+#   * the referrers of the manifest, e.g. signatures and provenance, by artifact type and digest
+#   * with the --files parameter, the files in the archive as listed in its index, see index-oci.sh
+# The manifest is found via the tag in the URI, for untagged artifacts and artifacts stored in a
+# directory only the archive is shown. The media type of archives stored locally, in an OCI image
+# layout or a directory, is then detected from their content.
+#
+# The --json parameter prints the same information as a JSON object instead, e.g.:
+#   {
+#     "uri": "oci:registry/org/repo:tag@sha256:123...",
+#     "type": "oci",
+#     "repository": "registry/org/repo",
+#     "tag": "tag",
+#     "digest": "sha256:123...",
+#     "size": 1234,
+#     "mediaType": "application/vnd.oci.image.layer.v1.tar+gzip",
+#     "annotations": {"org.opencontainers.image.title": "source"},
+#     "manifest": {"digest": "sha256:456...", "annotations": {...}},
+#     "referrers": [{"artifactType": "application/vnd.in-toto+json", "digest": "sha256:789..."}],
+#     "files": [{"path": "src", "type": "directory", "mode": "0755"}, ...]
+#   }
+# The tag and the manifest are null when there are none, the files are included only with the
+# --files parameter.
+#
+set -o errexit
+set -o nounset
+set -o pipefail
+
+if [[ -n "${DEBUG:-}" ]]; then
+  set -o xtrace
+fi
+
+uri=""
+json=""
+files=""
+
+while [[ $# -gt 0 ]]; do
+  case $1 in
+    --json)
+      json=1
+      shift
+      ;;
+    --files)
+      files=1
+      shift
+      ;;
+    -*)
+      echo "Unknown option $1" >&2
+      exit 1
+      ;;
+    *)
+      if [[ -n "${uri}" ]]; then
+        echo "Only one artifact can be inspected at a time, got: ${uri} and $1" >&2
+        exit 1
+      fi
+      uri="$1"
+      shift
+      ;;
+  esac
+done
+
+if [[ -z "${uri}" ]]; then
+    echo "Usage: inspect [--json] [--files] <artifact URI>" >&2
+    exit 1
+fi
+
+case "${uri/:*}" in
+    oci|oci-layout|file)
+        ;;
+    *)
+        echo "Unsupported archive type: ${uri/:*}" >&2
+        exit 1
+        ;;
+esac
+
+if [[ "${uri##*@}" != sha256:* ]]; then
+    echo "Unsupported artifact digest: ${uri##*@}, expected a sha256 digest" >&2
+    exit 1
+fi
+
+# read in any oras options
+source oras_opts.sh
+
+# fetches the manifest and the index of the artifact
+source artifacts.sh
+
+tmp_workdir=$(mktemp -d --tmpdir inspect-oci.sh.XXXXXX)
+trap 'rm -rf "${tmp_workdir}"' EXIT
+
+# Prints the layer media type of the given archive, based on how it is compressed.
+archive_media_type() {
+    case "$(decompress_opt "$1")" in
+        --gzip)
+            echo application/vnd.oci.image.layer.v1.tar+gzip
+            ;;
+        --zstd)
+            echo application/vnd.oci.image.layer.v1.tar+zstd
+            ;;
+        *)
+            echo application/vnd.oci.image.layer.v1.tar
+            ;;
+    esac
+}
+
+type="${uri/:*}"
+digest="${uri##*@}"
+repo="$(artifact_repo "${uri}")"
+ref="${uri#*:}"
+ref="${ref%@*}"
+tag=""
+if [[ "${ref}" != "${repo}" ]]; then
+    tag="${ref##*:}"
+fi
+
+target_opts=()
+artifact_target_opts "${uri}" "${tmp_workdir}" target_opts
+
+# the size of the archive, and its media type when stored locally
+case "${type}" in
+    oci)
+        if ! descriptor="$(oras blob fetch "${oras_opts[@]}" "${target_opts[@]}" --descriptor "${repo}@${digest}")"; then
+            echo "ERROR: artifact ${uri#*:} not found" >&2
+            exit 1
+        fi
+        descriptor="$(jq --compact-output '{size, mediaType: null}' <<< "${descriptor}")"
+        ;;
+    *)
+        archive="${repo}/sha256/${digest#sha256:}"
+        if [[ "${type}" == oci-layout ]]; then
+            archive="${repo}/blobs/sha256/${digest#sha256:}"
+        fi
+        if [[ ! -f "${archive}" ]]; then
+            echo "ERROR: artifact ${uri#*:} not found" >&2
+            exit 1
+        fi
+        descriptor="$(jq --null-input --compact-output --argjson size "$(stat --format=%s "${archive}")" \
+            --arg mediaType "$(archive_media_type "${archive}")" '{size: $size, mediaType: $mediaType}')"
+        ;;
+esac
+
+manifest="${tmp_workdir}/manifest.json"
+manifest_info=null
+layer='{}'
+referrers='[]'
+if fetch_manifest "${uri}" "${manifest}" "${target_opts[@]}"; then
+    manifest_digest="sha256:$(sha256sum "${manifest}" | cut -d' ' -f1)"
+    manifest_info="$(jq --compact-output --arg digest "${manifest_digest}" \
+        '{digest: $digest, annotations: (.annotations // {})}' "${manifest}")"
+    layer="$(jq --compact-output --arg digest "${digest}" 'first(.layers[] | select(.digest == $digest))' "${manifest}")"
+
+    if ! referrers="$(oras discover "${oras_opts[@]}" "${target_opts[@]}" --format json "${repo}@${manifest_digest}" \
+        | jq --compact-output '[(.manifests // .referrers // [])[] | {artifactType, digest}]')"; then
+        echo "WARN: unable to list the referrers of ${repo}@${manifest_digest}" >&2
+        referrers='[]'
+    fi
+fi
+
+index="${tmp_workdir}/index.json"
+echo '{"files": null}' > "${index}"
+if [[ -n "${files}" ]] && ! artifact_index "${uri}" "${index}" "${tmp_workdir}" "${target_opts[@]}"; then
+    echo "ERROR: unable to index artifact ${uri#*:}" >&2
+    exit 1
+fi
+
+info="$(jq --null-input \
+    --arg uri "${uri}" \
+    --arg type "${type}" \
+    --arg repository "${repo}" \
+    --arg tag "${tag}" \
+    --arg digest "${digest}" \
+    --argjson descriptor "${descriptor}" \
+    --argjson layer "${layer}" \
+    --argjson manifest "${manifest_info}" \
+    --argjson referrers "${referrers}" \
+    --slurpfile index "${index}" \
+    '{
+        uri: $uri,
+        type: $type,
+        repository: $repository,
+        tag: (if $tag == "" then null else $tag end),
+        digest: $digest,
+        size: $descriptor.size,
+        mediaType: ($layer.mediaType // $descriptor.mediaType),
+        annotations: ($layer.annotations // {}),
+        manifest: $manifest,
+        referrers: $referrers
+    } + if $index[0].files == null then {} else {files: $index[0].files} end')"
+
+if [[ -n "${json}" ]]; then
+    jq . <<< "${info}"
+    exit 0
+fi
+
+jq --raw-output '
+    def lpad($width): tostring | (" " * ($width - length)) + .;
+    def field($name; $value): ($name + ":" | . + " " * (12 - length)) + ($value | tostring);
+    def entries: if length == 0 then "  (none)" else to_entries[] | "  \(.key): \(.value)" end;
+
+    field({oci: "Repository", "oci-layout": "OCI layout", file: "Directory"}[.type]; .repository),
+    field("Tag"; .tag // "(none)"),
+    field("Digest"; .digest),
+    field("Size"; "\(.size) bytes"),
+    field("Media type"; .mediaType // "(unknown)"),
+    "Layer annotations:",
+    (.annotations | entries),
+    if .manifest == null then
+        field("Manifest"; "(not found)")
+    else
+        field("Manifest"; .manifest.digest),
+        "Manifest annotations:",
+        (.manifest.annotations | entries),
+        "Referrers:",
+        if (.referrers | length) == 0 then "  (none)" else .referrers[] | "  \(.artifactType) \(.digest)" end
+    end,
+    if has("files") then
+        "Files:",
+        (.files[] | "  \(.mode) \(.size // "-" | lpad(12)) \(.path)\(
+            if .type == "directory" then "/" elif .type == "symlink" then " -> \(.target)" else "" end)")
+    else
+        empty
+    end' <<< "${info}"
@@ -0,0 +1,87 @@
+#!/bin/bash
+# Runs independent units of work concurrently, sourced by create-oci.sh and use-oci.sh.
+#
+# The number of units of work running at the same time is given by the jobs variable, which
+# defaults to 1 (one after another). Running one at a time, the output is printed as it is written.
+# Otherwise the output of each unit of work is printed once it finishes, so that the output of units
+# running at the same time is not interleaved, its standard output and standard error are kept
+# apart. If one of them fails, no further units are started and the ones still running are
+# cancelled. The errors of all failed units are then reported together.
+
+jobs="${jobs:-1}"
+
+# Runs the given function once for each index of the array with the given name, passing it the
+# index. The elements of the array describe the units of work in the progress and error messages.
+# Fails if any of the runs failed or was cancelled.
+run_jobs() {
+    local fn="$1"
+    local -n job_labels="$2"
+    local logs pid index status
+    local -a queue=("${!job_labels[@]}") failed=() cancelled=()
+    local -A running=()
+
+    logs="$(mktemp -d --tmpdir="${tmp_workdir}" jobs.XXXXXX)"
+
+    # each run gets its own process group, so that it can be cancelled together with the processes
+    # it started
+    set -o monitor
+
+    while [[ ${#running[@]} -gt 0 || ( ${#queue[@]} -gt 0 && ${#failed[@]} -eq 0 ) ]]; do
+        while [[ ${#queue[@]} -gt 0 && ${#failed[@]} -eq 0 && ${#running[@]} -lt ${jobs} ]]; do
+            index="${queue[0]}"
+            queue=("${queue[@]:1}")
+            # exiting on SIGTERM, rather than being killed by it, lets the run clean up after itself
+            if [[ ${jobs} -eq 1 ]]; then
+                ( trap 'exit 143' TERM; "${fn}" "${index}" ) &
+            else
+                ( trap 'exit 143' TERM; "${fn}" "${index}" ) > "${logs}/${index}.out" 2> "${logs}/${index}.err" &
+            fi
+            running[$!]="${index}"
+        done
+
+        status=0
+        wait -n -p pid "${!running[@]}" || status=$?
+        index="${running[${pid}]}"
+        unset "running[${pid}]"
+
+        if [[ ${jobs} -gt 1 ]]; then
+            cat "${logs}/${index}.out"
+            cat "${logs}/${index}.err" >&2
+        fi
+        if [[ ${status} -eq 0 ]]; then
+            continue
+        fi
+
+        failed+=("${index}")
+        for pid in "${!running[@]}"; do
+            kill -TERM -- "-${pid}" 2> /dev/null || true
+            wait "${pid}" || true
+            cancelled+=("${running[${pid}]}")
+            unset "running[${pid}]"
+        done
+    done
+
+    set +o monitor
+
+    if [[ ${#failed[@]} -eq 0 ]]; then
+        return 0
+    fi
+
+    cancelled+=("${queue[@]}")
+    for index in "${failed[@]}"; do
+        echo "ERROR: failed: ${job_labels[${index}]}"
+        if [[ ${jobs} -eq 1 ]]; then
+            # the errors have just been printed
+            continue
+        fi
+        # the errors reported, or the last line of the error output otherwise
+        if ! grep --no-filename '^ERROR' "${logs}/${index}.out" "${logs}/${index}.err" | sed 's/^/    /'; then
+            tail --lines=1 "${logs}/${index}.err" | sed 's/^/    /' >&2
+        fi
+    done
+    for index in "${cancelled[@]}"; do
+        echo "ERROR: cancelled: ${job_labels[${index}]}"
+    done
+
+    return 1
+}
@@ -25,3 +25,71 @@ fi
 if [[ -n "${DEBUG:-}" ]]; then
     oras_opts+=(--debug)
 fi
+
+# Appends the oras options with the TLS configuration for the given registry, as host[:port], to
+# the array with the given name. The configuration is read from a certs.d directory, laid out as in
+# containers-certs.d(5) and used by buildah and podman: <certs.d>/<host[:port]>/ holds the CA
+# certificates to trust for the registry, *.crt, e.g. ca.crt, and the client certificates to present
+# to it, *.cert, each with the private key in the file of the same name ending in .key, e.g.
+# client.cert and client.key. The certs.d directory is CERT_DIR when set, otherwise the first of
+# ~/.config/containers/certs.d, /etc/containers/certs.d and /etc/docker/certs.d that has a directory
+# for the registry. The CA certificates found there are trusted for the registry instead of CA_FILE
+# and the system trust store. Multiple CA certificates are combined into a bundle written to the
+# given directory. oras presents a single client certificate, so having more than one is an error.
+registry_tls_opts() {
+    local registry="$1" work="$2"
+    local -n tls_opts="$3"
+    local dir="" candidate cert bundle
+    local -a candidates=() cas=() certs=()
+
+    if [[ -n "${CERT_DIR:-}" ]]; then
+        candidates=("${CERT_DIR}")
+    else
+        candidates=("${HOME}/.config/containers/certs.d" /etc/containers/certs.d /etc/docker/certs.d)
+    fi
+
+    for candidate in "${candidates[@]}"; do
+        if [[ -d "${candidate}/${registry}" ]]; then
+            dir="${candidate}/${registry}"
+            break
+        fi
+    done
+
+    if [[ -z "${dir}" ]]; then
+        return 0
+    fi
+    echo "Using TLS configuration from ${dir}" >&2
+
+    mapfile -t cas < <(find -L "${dir}/" -maxdepth 1 -name '*.crt' -type f | sort)
+    case ${#cas[@]} in
+        0)
+            ;;
+        1)
+            tls_opts+=(--ca-file "${cas[0]}")
+            ;;
+        *)
+            bundle="$(mktemp --tmpdir="${work}" ca-XXXXXX.crt)"
+            cat "${cas[@]}" > "${bundle}"
+            tls_opts+=(--ca-file "${bundle}")
+            ;;
+    esac
+
+    mapfile -t certs < <(find -L "${dir}/" -maxdepth 1 -name '*.cert' -type f | sort)
+    for cert in "${certs[@]}"; do
+        if [[ ! -f "${cert%.cert}.key" ]]; then
+            echo "ERROR: missing the key ${cert%.cert}.key of the client certificate ${cert}" >&2
+            return 1
+        fi
+    done
+    case ${#certs[@]} in
+        0)
+            ;;
+        1)
+            tls_opts+=(--cert-file "${certs[0]}" --key-file "${certs[0]%.cert}.key")
+            ;;
+        *)
+            echo "ERROR: found ${#certs[@]} client certificates in ${dir}, only one can be presented to the registry: ${certs[*]}" >&2
+            return 1
+            ;;
+    esac
+}
@@ -2,11 +2,42 @@
 # Selects the expected token from ~/.docker/config.json given an image reference. Default
 # location of ~/.docker/config.json may be overriden by setting AUTHFILE
 #
+# Unless AUTHFILE is set, the auth files used by buildah and podman are searched as well, following
+# the precedence in containers-auth.json(5): ${REGISTRY_AUTH_FILE} or, if not set,
+# ${XDG_RUNTIME_DIR}/containers/auth.json, then ${XDG_CONFIG_HOME}/containers/auth.json, defaulting
+# to ~/.config/containers/auth.json, and ~/.docker/config.json last. The files are merged, an entry
+# in a file earlier in that order replaces the entry for the same key in the later ones.
+#
 # The format of ~/.docker/config.json is not well defined. Some clients allow the specification of
 # repository specific tokens, e.g. buildah and kubernetes, while others only allow registry specific
 # tokens, e.g. oras. This script serves as an adapter to allow repository specific tokens for
 # clients that do not support it.
 #
+# Credentials kept by a credential helper are resolved using the docker-credential-helpers
+# protocol, i.e. by running docker-credential-<helper> get. The helper configured for a registry or
+# repository in credHelpers takes precedence over the token in auths for the same key, as it does
+# for docker. The helper configured in credsStore is used for the registry when no token matches.
+#
+# Raw bearer tokens, e.g. a projected Kubernetes service account token or a token exchanged for
+# registry access by workload identity, are read from the files given in REGISTRY_TOKEN_FILES, a
+# space separated list of <registry or repository>=<path> pairs, e.g.
+# REGISTRY_TOKEN_FILES="quay.io/org=/var/run/secrets/tokens/quay". The file is read every time, so
+# rotated tokens are picked up, and its content is passed to the registry as is, as registrytoken.
+# For the same key, the token file takes precedence over credential helpers and auths. Entries with
+# an identitytoken, written by docker login for identity providers, are passed on as well and
+# exchanged for a registry token by oras.
+#
+# The most specific key matching the image reference is used: the repository, its parent
+# namespaces, the registry and then wildcard keys for the registry's parent domains, e.g.
+# *.registry.example.com matches sub.registry.example.com, but not registry.example.com itself.
+#
+# Both the image reference and the keys are canonicalized before matching: the URL scheme, and with
+# it any path, e.g. https://index.docker.io/v1/, and trailing slashes are removed from the keys, the
+# Docker Hub aliases index.docker.io, registry-1.docker.io and registry.hub.docker.com become
+# docker.io, and the implicit docker.io registry and library/ namespace are added to the image
+# reference, e.g. ubuntu becomes docker.io/library/ubuntu. The token for Docker Hub is written for
+# https://index.docker.io/v1/, the key docker login uses.
+#
 # If the provided image reference contains a tag or a digest, those are ignored.
 #
 # Usage:
@@ -32,25 +63,197 @@ ref="${original_ref/@*}"
 # Remove tag from image reference while making sure optional registry port is taken into account
 ref="$(echo -n "$ref" | sed 's_/\(.*\):\(.*\)_/\1_g')"
 
+# Canonical form of the image references and the keys in the auth files
+normalize='
+    def normalize:
+        (if test("^[a-zA-Z][a-zA-Z0-9+.-]*://") then sub("^[^:]+://"; "") | sub("/.*$"; "") else . end)
+        | sub("/+$"; "")
+        | split("/")
+        | .[0] |= (if IN("index.docker.io", "registry-1.docker.io", "registry.hub.docker.com") then "docker.io" else . end)
+        | join("/");
+
+    # only for image references, in keys docker.io/name is a namespace, a lone name with a colon is a
+    # registry only if followed by a port, e.g. quay.io:443, and a repository with a tag otherwise
+    def qualify:
+        split("/")
+        | if (length > 1 or (.[0] | test(":[0-9]+$") or (contains(":") | not)))
+            and (.[0] | test("[.:]") or . == "localhost")
+          then
+            .
+          else
+            ["docker.io"] + . | .[-1] |= sub(":[^:]*$"; "")
+          end
+        | join("/")
+        | normalize
+        | split("/")
+        | if .[0] == "docker.io" and length == 2 then [.[0], "library", .[1]] else . end
+        | join("/");
+'
+
+ref="$(jq --null-input --raw-output --arg ref "${ref}" "${normalize}"' $ref | qualify')"
+
 registry="${ref/\/*}"
 
-AUTHFILE="${AUTHFILE:-$HOME/.docker/config.json}"
+if [[ -n "${AUTHFILE:-}" ]]; then
+    authfiles=("${AUTHFILE}")
+else
+    authfiles=()
+    if [[ -n "${REGISTRY_AUTH_FILE:-}" ]]; then
+        authfiles+=("${REGISTRY_AUTH_FILE}")
+    elif [[ -n "${XDG_RUNTIME_DIR:-}" ]]; then
+        authfiles+=("${XDG_RUNTIME_DIR}/containers/auth.json")
+    fi
+    authfiles+=(
+        "${XDG_CONFIG_HOME:-$HOME/.config}/containers/auth.json"
+        "$HOME/.docker/config.json"
+    )
+fi
 
-if [[ -f $AUTHFILE ]]; then
-    while true; do
-        token=$(< "${AUTHFILE}" jq -c '.auths["'"$ref"'"]')
-        if [[ "$token" != "null" && "$token" != "" ]]; then
-            >&2 echo "Using token for $ref"
-            echo -n '{"auths": {"'"$registry"'": '"$token"'}}' | jq -c .
-            exit 0
-        fi
+# Prints the token for the given server from the given credential helper, in the format used in
+# auths. Fails if the helper does not have credentials for the server.
+helper_token() {
+    local helper="$1" server="$2" credentials
 
-        if [[ "$ref" != *"/"* ]]; then
-            break
-        fi
+    if ! command -v "docker-credential-${helper}" > /dev/null; then
+        >&2 echo "Credential helper docker-credential-${helper} not found"
+        return 1
+    fi
+
+    if ! credentials="$(echo -n "${server}" | "docker-credential-${helper}" get 2> /dev/null)"; then
+        return 1
+    fi
+
+    # the <token> user name denotes an identity token, as with docker login
+    echo -n "${credentials}" | jq --compact-output --exit-status '
+        select(.Secret != null and .Secret != "")
+        | if .Username == "<token>" then
+            {identitytoken: .Secret}
+          else
+            {auth: ("\(.Username):\(.Secret)" | @base64)}
+          end'
+}
+
+# Prints the server address to use for the given key with credential helpers and in auth files,
+# that is the Docker Hub URL for docker.io and the key otherwise.
+server_address() {
+    if [[ "$1" == "docker.io" ]]; then
+        echo -n "https://index.docker.io/v1/"
+    else
+        echo -n "$1"
+    fi
+}
+
+# Prints the token read from the given file, in the format used in auths. Fails if the file cannot
+# be read or is empty.
+file_token() {
+    if [[ ! -r "$1" ]]; then
+        >&2 echo "Token file $1 not found"
+        return 1
+    fi
+
+    if ! jq --null-input --compact-output --exit-status --rawfile token "$1" \
+        '$token | gsub("^\\s+|\\s+$"; "") | select(. != "") | {registrytoken: .}'; then
+        >&2 echo "Token file $1 is empty"
+        return 1
+    fi
+}
+
+# Prints the auth file with the given token for the registry.
+print_auth() {
+    jq --null-input --compact-output --arg registry "$(server_address "${registry}")" --argjson token "$1" \
+        '{auths: {($registry): $token}}'
+}
 
-        ref="${ref%*/*}"
+# Prints the configuration merged from the existing auth files, the first file taking precedence.
+merged_config() {
+    local authfile
+    local -a configs=()
+
+    for authfile in "${authfiles[@]}"; do
+        if [[ -f "${authfile}" ]]; then
+            configs+=("$(jq --slurp --compact-output '.[0] // {}' "${authfile}")")
+        fi
     done
+
+    # within a file, the first non-empty entry of the keys with the same canonical form is used
+    jq --null-input --compact-output --arg token_files "${REGISTRY_TOKEN_FILES:-}" "${normalize}"'
+        def canonical:
+            reduce (to_entries[]) as $entry ({};
+                .[$entry.key | normalize] |= (if . == null or . == {} then $entry.value else . end));
+
+        reduce ($ARGS.positional | reverse[] | fromjson) as $config ({};
+            .auths += ($config.auths // {} | canonical)
+            | .credHelpers += ($config.credHelpers // {} | canonical)
+            | .credsStore = ($config.credsStore // .credsStore))
+        | .tokenFiles = ([$token_files | splits(" +") | capture("^(?<key>[^=]+)=(?<value>.+)$")]
+            | from_entries | canonical)' --args "${configs[@]}"
+}
+
+token_files=()
+if [[ -n "${REGISTRY_TOKEN_FILES:-}" ]]; then
+    IFS=' ' read -ra token_files <<< "${REGISTRY_TOKEN_FILES}"
+fi
+for token_file in "${token_files[@]}"; do
+    if [[ "${token_file}" != ?*=?* ]]; then
+        >&2 echo "Ignoring ${token_file} in REGISTRY_TOKEN_FILES, expected <registry or repository>=<path>"
+    fi
+done
+
+config="$(merged_config)"
+
+# the keys to look for, from the most specific
+keys=()
+while true; do
+    keys+=("${ref}")
+
+    if [[ "$ref" != *"/"* ]]; then
+        break
+    fi
+
+    ref="${ref%*/*}"
+done
+
+domain="${registry}"
+while [[ "${domain%%:*}" == *.*.* ]]; do
+    domain="${domain#*.}"
+    keys+=("*.${domain}")
+done
+
+for key in "${keys[@]}"; do
+    # helpers configured for a wildcard key are asked for the registry
+    server="$(server_address "${key}")"
+    if [[ "${key}" == "*."* ]]; then
+        server="$(server_address "${registry}")"
+    fi
+
+    token_file="$(jq --raw-output --arg key "${key}" '.tokenFiles[$key] // ""' <<< "${config}")"
+    if [[ -n "${token_file}" ]] && token="$(file_token "${token_file}")"; then
+        >&2 echo "Using token for $key from ${token_file}"
+        print_auth "${token}"
+        exit 0
+    fi
+
+    helper="$(jq --raw-output --arg key "${key}" '.credHelpers[$key] // ""' <<< "${config}")"
+    if [[ -n "${helper}" ]] && token="$(helper_token "${helper}" "${server}")"; then
+        >&2 echo "Using token for $key from credential helper ${helper}"
+        print_auth "${token}"
+        exit 0
+    fi
+
+    # credential stores leave empty entries in auths
+    token="$(jq --compact-output --arg key "${key}" '.auths[$key] | select(. != null and . != {})' <<< "${config}")"
+    if [[ -n "${token}" ]]; then
+        >&2 echo "Using token for $key"
+        print_auth "${token}"
+        exit 0
+    fi
+done
+
+store="$(jq --raw-output '.credsStore // ""' <<< "${config}")"
+if [[ -n "${store}" ]] && token="$(helper_token "${store}" "$(server_address "${registry}")")"; then
+    >&2 echo "Using token for $registry from credential store ${store}"
+    print_auth "${token}"
+    exit 0
 fi
 
 >&2 echo "Token not found for $original_ref"
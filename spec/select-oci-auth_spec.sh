@@ -78,6 +78,397 @@ Describe 'select-oci-auth.sh'
 
 End
 
+Describe 'credential helpers'
+    setup() {
+        export AUTHFILE="$(mktemp --tmpdir build-trusted-artifacts.XXX)"
+        helpers="$(mktemp -d --tmpdir build-trusted-artifacts.XXX)"
+        export PATH="${helpers}:${PATH}"
+
+        # responds as docker-credential-helpers do, the secrets are given via the environment
+        cat > "${helpers}/docker-credential-stub" <<'HELPER'
+#!/bin/bash
+[[ "$1" == "get" ]] || exit 1
+server="$(cat)"
+case "${server}" in
+    quay.io)
+        echo '{"ServerURL":"quay.io","Username":"spam","Secret":"'"${QUAYIO_HELPER_SECRET}"'"}'
+        ;;
+    quay.io/spam)
+        echo '{"ServerURL":"quay.io/spam","Username":"<token>","Secret":"'"${QUAYIO_SPAM_HELPER_SECRET}"'"}'
+        ;;
+    *)
+        echo "credentials not found in native keychain"
+        exit 1
+        ;;
+esac
+HELPER
+        chmod +x "${helpers}/docker-credential-stub"
+
+        export QUAYIO_HELPER_SECRET="$(random_secret)"
+        export QUAYIO_SPAM_HELPER_SECRET="$(random_secret)"
+    }
+
+    cleanup() {
+        rm -rf "${AUTHFILE}" "${helpers}"
+    }
+
+    Before 'setup'
+    After 'cleanup'
+
+    Describe 'credHelpers'
+        write_authfile() {
+            echo '{
+                "auths":{
+                    "quay.io/spam":{"auth":"'$quayio_spam_secret'"},
+                    "quay.io/bacon":{"auth":"'$quayio_secret'"}
+                },
+                "credHelpers":{
+                    "quay.io":"stub",
+                    "quay.io/spam":"stub",
+                    "quay.local":"stub",
+                    "registry.local":"missing"
+                }
+            }' > "${AUTHFILE}"
+        }
+
+        Before 'write_authfile'
+
+        It 'uses the helper for the registry'
+            When run script ./select-oci-auth.sh quay.io/eggs
+            The output should eq '{"auths":{"quay.io":{"auth":"'"$(echo -n "spam:${QUAYIO_HELPER_SECRET}" | base64 -w0)"'"}}}'
+            The error should include "Using token for quay.io from credential helper stub"
+        End
+
+        It 'uses the helper for the repository in favor of auths'
+            When run script ./select-oci-auth.sh quay.io/spam/bacon:latest
+            The output should eq '{"auths":{"quay.io":{"identitytoken":"'"${QUAYIO_SPAM_HELPER_SECRET}"'"}}}'
+            The error should include "Using token for quay.io/spam from credential helper stub"
+        End
+
+        It 'prefers the more specific repository token in auths'
+            When run script ./select-oci-auth.sh quay.io/bacon/eggs
+            The output should eq '{"auths":{"quay.io":{"auth":"'$quayio_secret'"}}}'
+            The error should include "Using token for quay.io/bacon"
+        End
+
+        It 'does not match when the helper has no credentials'
+            When run script ./select-oci-auth.sh quay.local/spam
+            The output should eq '{"auths": {}}'
+            The error should include "Token not found"
+        End
+
+        It 'does not match when the helper is missing'
+            When run script ./select-oci-auth.sh registry.local/spam
+            The output should eq '{"auths": {}}'
+            The error should include "Credential helper docker-credential-missing not found"
+        End
+    End
+
+    Describe 'credsStore'
+        write_authfile() {
+            echo '{
+                "auths":{
+                    "quay.io":{},
+                    "quay.io/spam":{"auth":"'$quayio_spam_secret'"}
+                },
+                "credsStore":"stub"
+            }' > "${AUTHFILE}"
+        }
+
+        Before 'write_authfile'
+
+        It 'uses the store for the registry'
+            When run script ./select-oci-auth.sh quay.io/eggs@sha256:abc
+            The output should eq '{"auths":{"quay.io":{"auth":"'"$(echo -n "spam:${QUAYIO_HELPER_SECRET}" | base64 -w0)"'"}}}'
+            The error should include "Using token for quay.io from credential store stub"
+        End
+
+        It 'prefers the repository token in auths'
+            When run script ./select-oci-auth.sh quay.io/spam/bacon
+            The output should eq '{"auths":{"quay.io":{"auth":"'$quayio_spam_secret'"}}}'
+            The error should include "Using token for quay.io/spam"
+        End
+
+        It 'does not match when the store has no credentials'
+            When run script ./select-oci-auth.sh quay.local/spam
+            The output should eq '{"auths": {}}'
+            The error should include "Token not found"
+        End
+    End
+End
+
+Describe 'containers auth files'
+    setup() {
+        unset AUTHFILE REGISTRY_AUTH_FILE XDG_CONFIG_HOME
+        export HOME="$(mktemp -d --tmpdir build-trusted-artifacts.XXX)"
+        export XDG_RUNTIME_DIR="${HOME}/run"
+        mkdir -p "${HOME}/.docker" "${HOME}/.config/containers" "${XDG_RUNTIME_DIR}/containers"
+
+        runtime_secret="$(random_secret)"
+        config_secret="$(random_secret)"
+        config_spam_secret="$(random_secret)"
+        docker_secret="$(random_secret)"
+        registry_auth_file_secret="$(random_secret)"
+        wildcard_secret="$(random_secret)"
+        wildcard_sub_secret="$(random_secret)"
+
+        echo '{"auths":{
+            "quay.io":{"auth":"'$runtime_secret'"},
+            "*.example.com":{"auth":"'$wildcard_secret'"}
+        }}' > "${XDG_RUNTIME_DIR}/containers/auth.json"
+        echo '{"auths":{
+            "quay.io":{"auth":"'$config_secret'"},
+            "quay.io/spam":{"auth":"'$config_spam_secret'"},
+            "*.sub.example.com":{"auth":"'$wildcard_sub_secret'"}
+        }}' > "${HOME}/.config/containers/auth.json"
+        echo '{"auths":{
+            "quay.io":{"auth":"'$docker_secret'"},
+            "ghcr.io":{"auth":"'$docker_secret'"}
+        }}' > "${HOME}/.docker/config.json"
+        echo '{"auths":{
+            "quay.io":{"auth":"'$registry_auth_file_secret'"}
+        }}' > "${HOME}/registry-auth.json"
+    }
+
+    cleanup() {
+        rm -rf "${HOME}"
+    }
+
+    Before 'setup'
+    After 'cleanup'
+
+    Describe 'matches'
+        Parameters
+            'quay.io/bacon' quay.io runtime_secret
+            'quay.io/spam/bacon' quay.io config_spam_secret
+            'ghcr.io/spam' ghcr.io docker_secret
+            'registry.example.com/spam' registry.example.com wildcard_secret
+            'a.b.example.com/spam' a.b.example.com wildcard_secret
+            'registry.sub.example.com/spam' registry.sub.example.com wildcard_sub_secret
+        End
+
+        It "$1"
+            When run script ./select-oci-auth.sh $1
+            The output should eq '{"auths":{"'$2'":{"auth":"'"${!3}"'"}}}'
+            The error should include "Using token for"
+        End
+    End
+
+    Describe 'does not match'
+        Parameters
+            'example.com/spam'
+            'sub.example.com.local/spam'
+            'registry.example.com:5000/spam'
+        End
+
+        It "$1"
+            When run script ./select-oci-auth.sh $1
+            The output should eq '{"auths": {}}'
+            The error should include "Token not found"
+        End
+    End
+
+    It 'uses XDG_CONFIG_HOME'
+        export XDG_CONFIG_HOME="${HOME}/config"
+        mkdir -p "${XDG_CONFIG_HOME}/containers"
+        mv "${HOME}/.config/containers/auth.json" "${XDG_CONFIG_HOME}/containers/auth.json"
+        When run script ./select-oci-auth.sh quay.io/spam
+        The output should eq '{"auths":{"quay.io":{"auth":"'$config_spam_secret'"}}}'
+        The error should include "Using token for quay.io/spam"
+    End
+
+    It 'uses REGISTRY_AUTH_FILE instead of the runtime auth file'
+        export REGISTRY_AUTH_FILE="${HOME}/registry-auth.json"
+        When run script ./select-oci-auth.sh quay.io/bacon
+        The output should eq '{"auths":{"quay.io":{"auth":"'$registry_auth_file_secret'"}}}'
+        The error should include "Using token for quay.io"
+    End
+
+    It 'uses only AUTHFILE when set'
+        export AUTHFILE="${HOME}/registry-auth.json"
+        When run script ./select-oci-auth.sh ghcr.io/spam
+        The output should eq '{"auths": {}}'
+        The error should include "Token not found"
+    End
+End
+
+Describe 'canonical keys'
+    setup() {
+        export AUTHFILE="$(mktemp --tmpdir build-trusted-artifacts.XXX)"
+        helpers="$(mktemp -d --tmpdir build-trusted-artifacts.XXX)"
+        canonical_secret="$(random_secret)"
+    }
+
+    cleanup() {
+        rm -rf "${AUTHFILE}" "${helpers}"
+    }
+
+    Before 'setup'
+    After 'cleanup'
+
+    Describe 'Docker Hub'
+        Parameters:matrix
+            'https://index.docker.io/v1/' 'https://index.docker.io/v1' 'index.docker.io' 'docker.io' \
+                'registry-1.docker.io' 'registry.hub.docker.com' 'https://registry-1.docker.io/v2/' \
+                'docker.io/library' 'index.docker.io/library/spam'
+            'spam' 'spam:latest' 'library/spam' 'docker.io/spam' 'docker.io/library/spam' \
+                'index.docker.io/library/spam' 'registry-1.docker.io/library/spam@sha256:abc' \
+                'registry.hub.docker.com/spam'
+        End
+
+        It "$1 matches $2"
+            echo '{"auths":{"'$1'":{"auth":"'$canonical_secret'"}}}' > "${AUTHFILE}"
+            When run script ./select-oci-auth.sh $2
+            The output should eq '{"auths":{"https://index.docker.io/v1/":{"auth":"'$canonical_secret'"}}}'
+            The error should include "Using token for docker.io"
+        End
+    End
+
+    Describe 'Docker Hub namespaces'
+        Parameters:matrix
+            'docker.io/spam' 'https://index.docker.io/v1/spam' 'registry-1.docker.io/spam/'
+            'spam/bacon' 'docker.io/spam/bacon' 'index.docker.io/spam/bacon:latest'
+        End
+
+        It "$1 matches $2"
+            echo '{"auths":{"'$1'":{"auth":"'$canonical_secret'"}}}' > "${AUTHFILE}"
+            When run script ./select-oci-auth.sh $2
+            The output should eq '{"auths":{"https://index.docker.io/v1/":{"auth":"'$canonical_secret'"}}}'
+            The error should include "Using token for docker.io"
+        End
+    End
+
+    Describe 'URLs'
+        Parameters
+            'https://quay.io' 'quay.io/spam' 'quay.io'
+            'https://quay.io/' 'quay.io/spam' 'quay.io'
+            'http://quay.io:5000/v2/' 'quay.io:5000/spam' 'quay.io:5000'
+            'quay.io/' 'quay.io/spam' 'quay.io'
+            'quay.io/spam/' 'quay.io/spam/bacon' 'quay.io'
+            'localhost:5000' 'localhost:5000/spam' 'localhost:5000'
+            'localhost' 'localhost/spam' 'localhost'
+        End
+
+        It "$1 matches $2"
+            echo '{"auths":{"'$1'":{"auth":"'$canonical_secret'"}}}' > "${AUTHFILE}"
+            When run script ./select-oci-auth.sh $2
+            The output should eq '{"auths":{"'$3'":{"auth":"'$canonical_secret'"}}}'
+            The error should include "Using token for"
+        End
+    End
+
+    Describe 'does not match'
+        Parameters
+            'docker.io/library' 'spam/bacon'
+            'docker.io/spam' 'spam'
+            'docker.io' 'quay.io/spam'
+            'https://quay.io' 'docker.io/spam'
+        End
+
+        It "$1 does not match $2"
+            echo '{"auths":{"'$1'":{"auth":"'$canonical_secret'"}}}' > "${AUTHFILE}"
+            When run script ./select-oci-auth.sh $2
+            The output should eq '{"auths": {}}'
+            The error should include "Token not found"
+        End
+    End
+
+    It 'prefers a non-empty entry among aliases'
+        echo '{"auths":{"docker.io":{},"https://index.docker.io/v1/":{"auth":"'$canonical_secret'"}}}' > "${AUTHFILE}"
+        When run script ./select-oci-auth.sh spam
+        The output should eq '{"auths":{"https://index.docker.io/v1/":{"auth":"'$canonical_secret'"}}}'
+        The error should include "Using token for docker.io"
+    End
+
+    It 'asks credential helpers for Docker Hub by its URL'
+        export PATH="${helpers}:${PATH}"
+        echo '#!/bin/bash
+[[ "$(cat)" == "https://index.docker.io/v1/" ]] || exit 1
+echo "{\"Username\":\"spam\",\"Secret\":\"'$canonical_secret'\"}"' > "${helpers}/docker-credential-stub"
+        chmod +x "${helpers}/docker-credential-stub"
+        echo '{"credHelpers":{"index.docker.io":"stub"}}' > "${AUTHFILE}"
+        When run script ./select-oci-auth.sh spam/bacon
+        The output should eq '{"auths":{"https://index.docker.io/v1/":{"auth":"'"$(echo -n "spam:${canonical_secret}" | base64 -w0)"'"}}}'
+        The error should include "from credential helper stub"
+    End
+End
+
+Describe 'tokens'
+    setup() {
+        export AUTHFILE="$(mktemp --tmpdir build-trusted-artifacts.XXX)"
+        tokens="$(mktemp -d --tmpdir build-trusted-artifacts.XXX)"
+
+        identity_token="$(random_secret)"
+        registry_token="$(random_secret)"
+        echo '{"auths":{
+            "quay.io":{"auth":"'$quayio_secret'"},
+            "quay.io/spam":{"identitytoken":"'$identity_token'"}
+        }}' > "${AUTHFILE}"
+        printf '%s\n' "${registry_token}" > "${tokens}/registry.token"
+        touch "${tokens}/empty.token"
+    }
+
+    cleanup() {
+        rm -rf "${AUTHFILE}" "${tokens}"
+    }
+
+    Before 'setup'
+    After 'cleanup'
+
+    It 'passes identity tokens on'
+        When run script ./select-oci-auth.sh quay.io/spam/bacon
+        The output should eq '{"auths":{"quay.io":{"identitytoken":"'$identity_token'"}}}'
+        The error should include "Using token for quay.io/spam"
+    End
+
+    Describe 'token files'
+        # {tokens} is replaced with the directory of the token files
+        Parameters
+            'quay.io/spam={tokens}/registry.token' 'quay.io/spam/bacon' quay.io
+            'quay.io={tokens}/registry.token' 'quay.io/bacon' quay.io
+            'quay.io/bacon={tokens}/registry.token quay.io/spam={tokens}/registry.token' 'quay.io/spam' quay.io
+            'https://quay.io/={tokens}/registry.token' 'quay.io/bacon' quay.io
+            '*.example.com={tokens}/registry.token' 'registry.example.com/spam' registry.example.com
+            'index.docker.io={tokens}/registry.token' 'spam' 'https://index.docker.io/v1/'
+        End
+
+        It "$1 is used for $2"
+            export REGISTRY_TOKEN_FILES="${1//\{tokens\}/${tokens}}"
+            When run script ./select-oci-auth.sh $2
+            The output should eq '{"auths":{"'$3'":{"registrytoken":"'$registry_token'"}}}'
+            The error should include "from ${tokens}/registry.token"
+        End
+    End
+
+    It 'prefers the more specific key in auths'
+        export REGISTRY_TOKEN_FILES="quay.io=${tokens}/registry.token"
+        When run script ./select-oci-auth.sh quay.io/spam/bacon
+        The output should eq '{"auths":{"quay.io":{"identitytoken":"'$identity_token'"}}}'
+        The error should include "Using token for quay.io/spam"
+    End
+
+    It 'ignores an empty token file'
+        export REGISTRY_TOKEN_FILES="quay.io=${tokens}/empty.token"
+        When run script ./select-oci-auth.sh quay.io/bacon
+        The output should eq '{"auths":{"quay.io":{"auth":"'$quayio_secret'"}}}'
+        The error should include "Token file ${tokens}/empty.token is empty"
+    End
+
+    It 'ignores a missing token file'
+        export REGISTRY_TOKEN_FILES="quay.io=${tokens}/missing.token"
+        When run script ./select-oci-auth.sh quay.io/bacon
+        The output should eq '{"auths":{"quay.io":{"auth":"'$quayio_secret'"}}}'
+        The error should include "Token file ${tokens}/missing.token not found"
+    End
+
+    It 'ignores malformed entries'
+        export REGISTRY_TOKEN_FILES="${tokens}/registry.token"
+        When run script ./select-oci-auth.sh quay.io/bacon
+        The output should eq '{"auths":{"quay.io":{"auth":"'$quayio_secret'"}}}'
+        The error should include "expected <registry or repository>=<path>"
+    End
+End
+
 It 'missing parameter'
     When run script ./select-oci-auth.sh
     The error should eq "Specify the image reference to match"
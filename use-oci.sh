@@ -1,6 +1,13 @@
 #!/bin/bash
 # Restores a trusted artifact, content of the destination will be removed.
 #
+# The --restore-mode parameter controls what happens to the existing content of the destination:
+#   * clean (default)   - the content of the destination is removed before the artifact is restored
+#   * merge             - the artifact is restored on top of the existing content of the destination
+#   * fail-if-not-empty - the restore fails if the destination contains any files
+# Restoring several artifacts to the same destination restores them all, one after another in the
+# given order, the destination is cleaned, or checked for content, only before the first of them.
+# The destination is not cleaned if the artifact could not be fetched or validated.
 #
 # Positional parametes are artifact pairs. These are strings. Each contains two parts separated by
 # an equal sign (=). The left portion refers to the uri of where the artifact can be fetch from.
@@ -9,21 +16,351 @@
 # oci:registry/org/repo:latest@sha256:123=/home/user/Downloads/artifact means the artifact will be
 # fetched from registry/org/repo and extract to the /home/user/Downloads/artifact directory.
 #
+# The left portion can also be prefixed with "file:" to restore an artifact stored in a directory by
+# create-oci.sh, e.g. file:/workspace/artifacts@sha256:123=/home/user/Downloads/artifact, or with
+# "oci-layout:" to restore an artifact from an OCI image layout directory, e.g.
+# oci-layout:/workspace/layout@sha256:123=/home/user/Downloads/artifact. The content of the archive
+# is verified against the digest before restoring it in any case.
+#
+# The artifact is first extracted into a staging directory on the same filesystem as the
+# destination, and the extracted content is compared with the archive. If anything fails, the
+# staging directory is removed and the destination is left as it was. In the clean restore mode, the
+# staging directory is created next to the destination, and renamed in its place once complete, so
+# consumers see either the complete artifact or none of it. That is not possible when the
+# destination is a mount point, e.g. the root of a volume, or its parent directory is not writable,
+# when restoring in the merge mode, or when restoring several artifacts to the same destination
+# after the first one. The staging directory is then created inside of the destination and its
+# content moved, or copied in the merge mode, into the destination, so consumers could see a
+# partially restored artifact while that happens.
+#
+# Every member of the archive is validated before anything is extracted. Archives containing members
+# with absolute paths or ".." components, links pointing outside of the destination or through a
+# symbolic link in the archive, or members that would be written through a symbolic link are
+# refused as a whole.
+#
+# The --verify-key parameter names a PEM encoded public key, e.g. cosign.pub. When provided, the
+# artifacts are restored only if the manifest containing them carries a valid signature made with
+# the matching private key, as attached by create-oci.sh --sign-key or by cosign. The manifest is
+# found via the tag in the artifact URI, so only tagged artifacts can be verified.
+#
+# When the TRUSTED_ARTIFACTS_INPUTS environment variable is set, the URIs of the restored artifacts
+# are appended to the file it names, so that create-oci.sh can record them as inputs in the
+# provenance of the artifacts created later on.
+#
+# The --jobs parameter sets how many destinations are restored at the same time, one at a time by
+# default. Destinations nested in one another are never restored at the same time: if there are any,
+# all the destinations are restored one at a time. If restoring any of them fails, the remaining
+# work is cancelled and all the errors are reported.
+#
+# The --cache-dir parameter names a directory, e.g. on a shared volume, used to cache the archives
+# fetched from a registry, named by their digest: <directory>/sha256/<digest>. Cached archives are
+# used instead of fetching them again, but they are verified against the digest just like fetched
+# ones, and replaced if they do not match. The cache is pruned after restoring the artifacts: the
+# --cache-max-age parameter removes archives not used for the given number of days and the
+# --cache-max-size parameter, e.g. 10G, removes the least recently used archives once the cache
+# grows over the given size.
+#
+# The archive can be compressed with gzip, zstd or not compressed at all. The compression is
+# detected from the content of the archive, so it doesn't need to be specified.
+#
 set -o errexit
 set -o nounset
 set -o pipefail
 
-tar_opts=-zxpf
+tar_opts=(--extract --preserve-permissions)
 if [[ -n "${DEBUG:-}" ]]; then
-  tar_opts=-zxvpf
+  tar_opts+=(--verbose)
   set -o xtrace
 fi
 
+# Copies the cached archive with the given digest, if there is one matching the digest, to the given
+# path. Cached archives that do not match the digest are removed from the cache.
+fetch_cached() {
+    local digest="$1" archive="$2"
+    local cached="${cache_dir}/sha256/${digest#sha256:}"
+
+    if [[ ! -f "${cached}" ]]; then
+        return 1
+    fi
+
+    if cp "${cached}" "${archive}" && matches_digest "${archive}" "${digest}"; then
+        # marks the archive as recently used for pruning
+        touch "${cached}" || true
+        return 0
+    fi
+
+    echo "WARN: cached archive ${cached} does not match its digest, fetching it again"
+    rm -f "${cached}"
+    return 1
+}
+
+# Adds the given archive to the cache, writing it under a temporary name first so that concurrent
+# restores never see a partially written archive.
+cache_archive() {
+    local archive="$1" digest="$2"
+    local tmp
+
+    mkdir -p "${cache_dir}/sha256" || return 1
+    tmp="$(mktemp "${cache_dir}/sha256/.tmp.XXXXXX")" || return 1
+    if ! cp "${archive}" "${tmp}" || ! mv -f "${tmp}" "${cache_dir}/sha256/${digest#sha256:}"; then
+        rm -f "${tmp}"
+        return 1
+    fi
+}
+
+# Removes the archives not used for longer than --cache-max-age days, and the least recently used
+# archives not fitting into --cache-max-size bytes.
+prune_cache() {
+    local total=0 size path
+
+    if [[ ! -d "${cache_dir}/sha256" ]]; then
+        return
+    fi
+
+    # left behind by interrupted restores
+    find "${cache_dir}/sha256" -maxdepth 1 -type f -name '.tmp.*' -mmin +60 -delete
+
+    if [[ -n "${cache_max_age}" ]]; then
+        find "${cache_dir}/sha256" -maxdepth 1 -type f ! -name '.*' -mmin "+$((cache_max_age * 24 * 60))" -delete
+    fi
+
+    if [[ -n "${cache_max_size}" ]]; then
+        while read -r _ size path; do
+            if [[ $((total + size)) -gt ${cache_max_size} ]]; then
+                rm -f "${path}"
+            else
+                total=$((total + size))
+            fi
+        done < <(find "${cache_dir}/sha256" -maxdepth 1 -type f ! -name '.*' -printf '%T@ %s %p\n' | sort -rn)
+    fi
+}
+
+# Verifies that the manifest referenced by the tag in the given artifact reference contains the
+# artifact with the given digest, and that the manifest is signed by the --verify-key. Signatures
+# attached to the manifest as referrers and signatures stored by cosign under the
+# sha256-<digest>.sig tag are both accepted. The remaining arguments select the oras target.
+verify_signature() {
+    local name="$1" digest="$2" work="$3"
+    shift 3
+    local target_opts=("$@")
+    local ref="${name%@*}" repo manifest_digest signature_manifest signature_manifests layer payload
+
+    if [[ "${ref##*/}" != *:* ]]; then
+        echo "ERROR: artifact ${name} is not tagged, the tag is needed to find the signed manifest"
+        return 1
+    fi
+    repo="${ref%:*}"
+
+    if ! retry oras manifest fetch "${oras_opts[@]}" "${target_opts[@]}" "${ref}" --output "${work}/manifest.json"; then
+        echo "ERROR: unable to fetch manifest ${ref}"
+        return 1
+    fi
+    manifest_digest="sha256:$(sha256sum "${work}/manifest.json" | cut -d' ' -f1)"
+
+    if ! jq --exit-status --arg digest "${digest}" 'any(.layers[]; .digest == $digest)' "${work}/manifest.json" > /dev/null; then
+        echo "ERROR: manifest ${ref}@${manifest_digest} does not contain artifact ${digest}"
+        return 1
+    fi
+
+    mapfile -t signature_manifests < <(oras discover "${oras_opts[@]}" "${target_opts[@]}" \
+        --artifact-type application/vnd.dev.cosign.artifact.sig.v1+json --format json \
+        "${repo}@${manifest_digest}" | jq --raw-output '(.manifests // .referrers // [])[].digest | "@" + .')
+    signature_manifests+=(":sha256-${manifest_digest#sha256:}.sig")
+
+    for signature_manifest in "${signature_manifests[@]}"; do
+        if ! oras manifest fetch "${oras_opts[@]}" "${target_opts[@]}" "${repo}${signature_manifest}" \
+            --output "${work}/signature-manifest.json" 2> /dev/null; then
+            continue
+        fi
+
+        while IFS= read -r layer; do
+            payload="${work}/payload.json"
+            if ! oras blob fetch "${oras_opts[@]}" "${target_opts[@]}" "${repo}@$(jq --raw-output .digest <<< "${layer}")" \
+                --output "${payload}" 2> /dev/null; then
+                continue
+            fi
+
+            # the payload must refer to the manifest, otherwise the signature of another manifest
+            # could be attached to it
+            if [[ "$(jq --raw-output '.critical.image["docker-manifest-digest"]' "${payload}")" != "${manifest_digest}" ]]; then
+                continue
+            fi
+
+            jq --raw-output '.annotations["dev.cosignproject.cosign/signature"]' <<< "${layer}" \
+                | base64 --decode > "${work}/signature" 2> /dev/null || continue
+
+            if openssl dgst -sha256 -verify "${verify_key}" -signature "${work}/signature" "${payload}" > /dev/null 2>&1; then
+                echo "Verified signature of manifest ${ref}@${manifest_digest}"
+                return 0
+            fi
+        done < <(jq --compact-output '.layers[]
+            | select(.mediaType == "application/vnd.dev.cosign.simplesigning.v1+json")
+            | select(.annotations["dev.cosignproject.cosign/signature"] != null)' "${work}/signature-manifest.json")
+    done
+
+    echo "ERROR: no valid signature found for manifest ${ref}@${manifest_digest}"
+    return 1
+}
+
+# Extracts the given archive to the staging directory and compares the extracted files with the
+# listing of the archive written by validate_archive: their type, mode, size and the target of
+# symbolic links. The content of the files is not read again, the archive has been verified against
+# its digest already, so files that can't be read, e.g. with mode 0200 when not running as root, are
+# verified as well. Ownership is not compared, it is expected to differ when not running as root.
+extract_staged() {
+    local archive="$1" decompress="$2" staging="$3"
+    local listing="${archive}.members"
+    local line type permissions size member target path kind mode length link expected expected_mode
+    local differences=""
+    local -A kinds=() modes=() sizes=() targets=()
+
+    tar -C "${staging}" "${tar_opts[@]}" ${decompress:+"${decompress}"} --file "${archive}" || return 1
+
+    # the type, octal mode, size and symbolic link target of every extracted file, from the directory
+    # entries alone
+    while IFS= read -r -d '' path && IFS= read -r -d '' kind && IFS= read -r -d '' mode \
+        && IFS= read -r -d '' length && IFS= read -r -d '' link; do
+        kinds["${path}"]="${kind}"
+        printf -v mode '%04o' "$((8#${mode}))"
+        modes["${path}"]="${mode}"
+        sizes["${path}"]="${length}"
+        targets["${path}"]="${link}"
+    done < <(find "${staging}" -mindepth 1 -printf '%P\0%y\0%m\0%s\0%l\0')
+
+    while IFS= read -r line; do
+        if [[ ! "${line}" =~ ${member_re} ]]; then
+            echo "ERROR: unable to parse the archive member: ${line}"
+            return 1
+        fi
+        type="${BASH_REMATCH[1]}"
+        permissions="${BASH_REMATCH[2]}"
+        size="${BASH_REMATCH[3]}"
+        decode_member "${BASH_REMATCH[4]}" member
+        decode_member "${BASH_REMATCH[8]}" target
+        octal_mode "${permissions}" expected_mode
+
+        if [[ -z "${member}" ]]; then
+            # the root of the archive, i.e. the staging directory
+            continue
+        fi
+
+        # hard links are extracted as regular files
+        expected="${type/[-h]/f}"
+        if [[ -z "${kinds[${member}]+set}" ]]; then
+            differences+="${member}: Not found"$'\n'
+        elif [[ "${kinds[${member}]}" != "${expected}" ]]; then
+            differences+="${member}: File type differs"$'\n'
+        elif [[ "${type}" == l ]]; then
+            if [[ "${targets[${member}]}" != "${target}" ]]; then
+                differences+="${member}: Symlink differs"$'\n'
+            fi
+        elif [[ "${modes[${member}]}" != "${expected_mode}" ]]; then
+            differences+="${member}: Mode differs"$'\n'
+        elif [[ "${type}" == - && "${sizes[${member}]}" != "${size}" ]]; then
+            differences+="${member}: Size differs"$'\n'
+        fi
+    done < "${listing}"
+
+    if [[ -n "${differences}" ]]; then
+        echo "ERROR: the extracted content does not match the archive:"
+        echo -n "${differences}"
+        return 1
+    fi
+}
+
+# Succeeds if the given destination can be replaced by renaming a directory next to it, i.e. its
+# parent directory is writable, allows renaming it, and it is not a mount point, which can't be
+# renamed.
+can_swap() {
+    local destination="$1" parent="${1%/*}"
+    parent="${parent:-/}"
+
+    if [[ ! -w "${parent}" ]] || [[ -k "${parent}" && ! -O "${destination}" ]]; then
+        return 1
+    fi
+
+    if [[ "$(stat --format=%d "${destination}")" != "$(stat --format=%d "${parent}")" ]]; then
+        return 1
+    fi
+
+    # bind mounts can be on the same device as their parent directory
+    ! cut --delimiter=' ' --fields=5 /proc/self/mountinfo | grep --quiet --line-regexp --fixed-strings "${destination}"
+}
+
+# Replaces the destination with the staging directory next to it. The destination is renamed out of
+# the way, the staging directory renamed in its place and the previous content of the destination
+# removed afterwards.
+swap_staged() {
+    local staging="$1" destination="$2"
+
+    mv --no-target-directory "${destination}" "${staging}.previous" || return 1
+    if ! mv --no-target-directory "${staging}" "${destination}"; then
+        mv --no-target-directory "${staging}.previous" "${destination}"
+        return 1
+    fi
+    rm -rf "${staging}.previous"
+}
+
+# Moves the content of the staging directory into the destination. When the destination is empty,
+# apart from the staging directory, the content is renamed into place, otherwise it is copied on top
+# of the existing content.
+install_staged() {
+    local staging="$1" destination="$2"
+
+    if [[ -z "$(find "${destination}" -mindepth 1 -maxdepth 1 ! -name "${staging##*/}" -print -quit)" ]]; then
+        find "${staging}" -mindepth 1 -maxdepth 1 -exec mv --target-directory="${destination}" {} +
+        chmod --reference="${staging}" "${destination}"
+    else
+        tar -C "${staging}" --create --file - . | tar -C "${destination}" "${tar_opts[@]}" --file -
+    fi
+    rm -rf "${staging}"
+}
+
 # contains name=path artifact pairs
 artifact_pairs=()
 
+restore_mode=clean
+verify_key=""
+cache_dir=""
+cache_max_age=""
+cache_max_size=""
+
 while [[ $# -gt 0 ]]; do
   case $1 in
+    --restore-mode)
+      restore_mode="$2"
+      shift
+      shift
+      ;;
+    --jobs)
+      jobs="$2"
+      shift
+      shift
+      ;;
+    --verify-key)
+      verify_key="$2"
+      shift
+      shift
+      ;;
+    --cache-dir)
+      cache_dir="$2"
+      shift
+      shift
+      ;;
+    --cache-max-age)
+      if [[ ! "$2" =~ ^[0-9]+$ ]]; then
+        echo "Invalid --cache-max-age: $2, expected a number of days"
+        exit 1
+      fi
+      cache_max_age="$2"
+      shift
+      shift
+      ;;
+    --cache-max-size)
+      cache_max_size="$(numfmt --from=iec "$2")"
+      shift
+      shift
+      ;;
     -*)
       echo "Unknown option $1"
       exit 1
@@ -35,11 +372,146 @@ while [[ $# -gt 0 ]]; do
   esac
 done
 
+case "${restore_mode}" in
+    clean|merge|fail-if-not-empty)
+        ;;
+    *)
+        echo "Unsupported restore mode: ${restore_mode}, expected one of: clean, merge, fail-if-not-empty"
+        exit 1
+        ;;
+esac
+
+if [[ ! "${jobs:-1}" =~ ^[1-9][0-9]*$ ]]; then
+    echo "--jobs must be a positive number, got: ${jobs}"
+    exit 1
+fi
+
+if [[ -n "${verify_key}" && ! -r "${verify_key}" ]]; then
+    echo "Unable to read the verification key: ${verify_key}"
+    exit 1
+fi
+
 # read in any oras options
 source oras_opts.sh
 
+# fetches and validates the archives
+source artifacts.sh
+
+# restores the artifacts to different destinations concurrently
+source jobs.sh
+
 tmp_workdir=$(mktemp -d --tmpdir use-oci.sh.XXXXXX)
-trap 'rm -rf $tmp_workdir' EXIT
+trap 'rm -rf "${tmp_workdir}"' EXIT
+
+# Fetches, verifies and restores the artifact with the given URI to the given destination. The
+# content of the destination is removed first in the clean restore mode if the third argument is
+# not empty.
+restore_artifact() {
+    local uri="$1" destination="$2" clean="$3"
+    local type name digest work archive cached decompress swap
+    local -a target_opts=()
+
+    type="${uri/:*}"
+    name="${uri#*:}"
+    digest="${name##*@}"
+
+    work="$(mktemp -d --tmpdir="${tmp_workdir}" restore.XXXXXX)"
+    archive="${work}/archive"
+    cached=""
+
+    artifact_target_opts "${uri}" "${work}" target_opts
+
+    if [[ -n "${cache_dir}" && "${type}" == oci ]] && fetch_cached "${digest}" "${archive}"; then
+        echo "Using cached archive of artifact ${name}"
+        cached=1
+    else
+        fetch_archive "${uri}" "${archive}" "${target_opts[@]}"
+    fi
+
+    # whatever the archive was fetched from, it must match the digest it is referenced by
+    if ! matches_digest "${archive}" "${digest}"; then
+        echo "ERROR: artifact ${name} does not match its digest"
+        exit 1
+    fi
+
+    if [[ -n "${verify_key}" ]] && ! verify_signature "${name}" "${digest}" "${work}" "${target_opts[@]}"; then
+        echo "ERROR: refusing to restore artifact ${name}"
+        exit 1
+    fi
+
+    if [[ -n "${cache_dir}" && "${type}" == oci && -z "${cached}" ]]; then
+        if ! cache_archive "${archive}" "${digest}"; then
+            echo "WARN: unable to cache the archive of artifact ${name}"
+        fi
+    fi
+
+    decompress="$(decompress_opt "${archive}")"
+
+    if ! validate_archive "${archive}" "${decompress}"; then
+        echo "ERROR: refusing to restore artifact ${name}"
+        exit 1
+    fi
+
+    # removed when restoring a destination it is nested in
+    mkdir -p "${destination}"
+
+    swap=""
+    if [[ "${restore_mode}" == clean && -n "${clean}" ]] && can_swap "${destination}"; then
+        swap=1
+        staging="$(mktemp -d "${destination%/*}/.${destination##*/}.trusted-artifacts-staging.XXXXXX")"
+    else
+        staging="$(mktemp -d "${destination}/.trusted-artifacts-staging.XXXXXX")"
+    fi
+    chmod --reference="${destination}" "${staging}"
+
+    if ! extract_staged "${archive}" "${decompress}" "${staging}"; then
+        echo "ERROR: failed to restore artifact ${name}, ${destination} was not modified"
+        exit 1
+    fi
+    rm -rf "${work}"
+
+    if [[ -n "${swap}" ]]; then
+        if ! swap_staged "${staging}" "${destination}"; then
+            echo "ERROR: failed to replace ${destination} with the restored artifact ${name}"
+            exit 1
+        fi
+    else
+        if [[ "${restore_mode}" == clean && -n "${clean}" ]]; then
+            find "${destination}" -mindepth 1 -maxdepth 1 ! -name "${staging##*/}" -exec rm -rf {} +
+        fi
+
+        install_staged "${staging}" "${destination}"
+    fi
+    staging=""
+
+    if [[ -n "${TRUSTED_ARTIFACTS_INPUTS:-}" ]]; then
+        # used by create-oci.sh to record the inputs in the provenance of the artifacts it creates
+        echo "${uri}" >> "${TRUSTED_ARTIFACTS_INPUTS}"
+    fi
+
+    echo "Restored artifact ${name} to ${destination}"
+}
+
+# Restores, one after another, all the artifacts restored to the destination with the given index.
+restore_destination() {
+    local destination="${destinations[$1]}"
+    local uri clean=1
+
+    # staging directory of the artifact being restored, removed if the restore fails
+    staging=""
+    trap 'rm -rf ${staging:+"${staging}"}' EXIT
+
+    while IFS= read -r uri; do
+        restore_artifact "${uri}" "${destination}" "${clean}"
+        clean=""
+    done <<< "${destination_uris[${destination}]}"
+}
+
+# destinations in the order they were given, and the URIs of the artifacts restored to each of them.
+# The destinations are restored concurrently, the artifacts restored to the same destination one
+# after another.
+destinations=()
+declare -A destination_uris=()
 
 for artifact_pair in "${artifact_pairs[@]}"; do
     uri="${artifact_pair/=*}"
@@ -65,28 +537,66 @@ for artifact_pair in "${artifact_pairs[@]}"; do
       continue
     fi
 
-    mkdir -p "${destination}"
-
     type="${uri/:*}"
+    name="${uri#*:}"
+    digest="${name##*@}"
 
-    if [ "${type}" != "oci" ]; then
-        echo Unsupported archive type: "${type}"
+    case "${type}" in
+        oci|oci-layout)
+            ;;
+        file)
+            if [[ -n "${verify_key}" ]]; then
+                echo "Artifacts stored in a directory are not signed, unable to verify ${uri}"
+                exit 1
+            fi
+            ;;
+        *)
+            echo Unsupported archive type: "${type}"
+            exit 1
+            ;;
+    esac
+
+    if [[ "${digest}" != sha256:* ]]; then
+        echo Unsupported artifact digest: "${digest}", expected a sha256 digest
         exit 1
     fi
 
-    name="${uri#*:}"
+    mkdir -p "${destination}"
 
-    authfile=$(mktemp --tmpdir="$tmp_workdir" "auth-XXXXXX.json")
-    select-oci-auth.sh "$name" > "$authfile"
+    if [[ -z "${destination_uris[${destination}]+set}" ]]; then
+        # left behind by a restore that was interrupted
+        find "${destination}" -mindepth 1 -maxdepth 1 -name '.trusted-artifacts-staging.*' -exec rm -rf {} +
+        find "${destination%/*}/" -mindepth 1 -maxdepth 1 -name ".${destination##*/}.trusted-artifacts-staging.*" \
+            -exec rm -rf {} +
 
-    oras_cmd=$(
-        printf '%q ' oras blob fetch "${oras_opts[@]}" --registry-config "$authfile" \
-            "${name}" --output -
-    )
-    tar_cmd=$(
-        printf '%q ' tar -C "${destination}" "${tar_opts}" -
-    )
-    retry /bin/bash -o pipefail -c "${oras_cmd} | ${tar_cmd}"
+        if [[ "${restore_mode}" == fail-if-not-empty && -n "$(find "${destination}" -mindepth 1 -maxdepth 1 -print -quit)" ]]; then
+            echo "ERROR: destination ${destination} is not empty"
+            exit 1
+        fi
 
-    echo "Restored artifact ${name} to ${destination}"
+        destinations+=("${destination}")
+        destination_uris["${destination}"]="${uri}"
+    else
+        destination_uris["${destination}"]+=$'\n'"${uri}"
+    fi
 done
+
+# restoring a destination replaces or removes the content of the ones nested in it, so those are
+# restored one after another, in the given order
+if [[ ${jobs:-1} -gt 1 ]]; then
+    for parent in "${destinations[@]}"; do
+        for nested in "${destinations[@]}"; do
+            if [[ "${nested}" != "${parent}" && "${nested}/" == "${parent}/"* ]]; then
+                echo "WARN: destination ${nested} is nested in ${parent}, restoring the artifacts one at a time"
+                jobs=1
+                break 2
+            fi
+        done
+    done
+fi
+
+run_jobs restore_destination destinations
+
+if [[ -n "${cache_dir}" ]]; then
+    prune_cache
+fi
@@ -0,0 +1,141 @@
+#!/bin/bash
+# Verifies that directories still match the trusted artifacts they were restored from
+#
+# Positional parameters are artifact pairs, the same as for use-oci.sh: the URI of the artifact and
+# the directory to verify, separated by an equal sign (=), e.g.
+# oci:registry/org/repo@sha256:123=/workspace/source. Each directory is compared with the content of
+# the artifact file by file: the set of files, their types, modes, sizes and sha256 digests, and the
+# targets of symbolic links. Ownership and timestamps are not compared.
+#
+# The archive of the artifact is fetched and verified against the digest in the URI, and the files
+# in it are indexed, so the result depends on nothing but the digest. The files added to, removed
+# from or modified in the directory are reported, and the script fails if any directory does not
+# match its artifact, e.g. when a step modified the restored sources before they are built.
+#
+# Files in the directory matching the patterns of the .trusted-artifacts-ignore file in the archive
+# are ignored, as are the ones matching the patterns given with the --exclude parameter, which can be
+# repeated, using the same syntax as create-oci.sh. Patterns excluded when creating the artifact with
+# --exclude need to be given again. The exclusions are never taken from the directory being
+# verified, nor from the index stored alongside the artifact, which is not tied to the digest, so
+# that whoever modified the directory can't hide the changes.
+#
+set -o errexit
+set -o nounset
+set -o pipefail
+
+if [[ -n "${DEBUG:-}" ]]; then
+  set -o xtrace
+fi
+
+# contains uri=path artifact pairs
+artifact_pairs=()
+
+excludes=()
+
+while [[ $# -gt 0 ]]; do
+  case $1 in
+    --exclude)
+      excludes+=("$2")
+      shift
+      shift
+      ;;
+    -*)
+      echo "Unknown option $1"
+      exit 1
+      ;;
+    *)
+      artifact_pairs+=("$1")
+      shift
+      ;;
+  esac
+done
+
+if [[ ${#artifact_pairs[@]} -eq 0 ]]; then
+    echo "Usage: verify [--exclude <pattern>]... <artifact URI>=<directory>..."
+    exit 1
+fi
+
+# read in any oras options
+source oras_opts.sh
+
+# fetches, indexes and compares the artifacts
+source artifacts.sh
+
+tmp_workdir=$(mktemp -d --tmpdir verify-oci.sh.XXXXXX)
+trap 'rm -rf "${tmp_workdir}"' EXIT
+
+# Compares the given directory with the artifact with the given URI, prints the differences and
+# fails if there are any.
+verify_directory() {
+    local uri="$1" directory="$2"
+    local name="${uri#*:}" work decompress
+    local -a target_opts=() patterns=("${excludes[@]}")
+
+    work="$(mktemp -d --tmpdir="${tmp_workdir}" verify.XXXXXX)"
+    artifact_target_opts "${uri}" "${work}" target_opts
+
+    if ! index_artifact_archive "${uri}" "${work}/artifact.json" "${work}" "${target_opts[@]}"; then
+        echo "ERROR: unable to index artifact ${name}"
+        return 1
+    fi
+
+    # the ignore file from the archive verified against the digest, the one in the directory could
+    # have been planted there
+    if jq --exit-status 'any(.files[]; .path == ".trusted-artifacts-ignore" and .type == "file")' \
+        "${work}/artifact.json" > /dev/null; then
+        mkdir "${work}/ignore"
+        decompress="$(decompress_opt "${work}/archive")"
+        tar --extract --to-stdout ${decompress:+"${decompress}"} --file "${work}/archive" \
+            ./.trusted-artifacts-ignore > "${work}/ignore/.trusted-artifacts-ignore"
+        read_ignore_file "${work}/ignore" patterns
+    fi
+
+    if ! index_directory "${directory}" "${work}" "${patterns[@]}" > "${work}/directory.json"; then
+        echo "ERROR: unable to index ${directory}"
+        return 1
+    fi
+
+    compare_indexes "${work}/artifact.json" "${work}/directory.json" > "${work}/changes.json"
+    rm -rf "${work}/archive" "${work}"/directory-*.tar
+
+    if jq --exit-status 'all(.[]; length == 0)' "${work}/changes.json" > /dev/null; then
+        echo "Verified ${directory} against artifact ${name}"
+        return 0
+    fi
+
+    echo "ERROR: ${directory} does not match artifact ${name}:"
+    print_changes < "${work}/changes.json"
+    return 1
+}
+
+failed=0
+for artifact_pair in "${artifact_pairs[@]}"; do
+    uri="${artifact_pair/=*}"
+    directory="${artifact_pair/*=}"
+
+    case "${uri/:*}" in
+        oci|oci-layout|file)
+            ;;
+        *)
+            echo "Unsupported archive type: ${uri/:*}"
+            exit 1
+            ;;
+    esac
+
+    if [[ "${uri##*@}" != sha256:* ]]; then
+        echo "Unsupported artifact digest: ${uri##*@}, expected a sha256 digest"
+        exit 1
+    fi
+
+    if [[ ! -d "${directory}" ]]; then
+        echo "ERROR: ${directory} is not a directory"
+        failed=1
+        continue
+    fi
+
+    if ! verify_directory "${uri}" "${directory}"; then
+        failed=1
+    fi
+done
+
+exit "${failed}"